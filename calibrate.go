@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"dark-detector/internal/calibration"
+	"dark-detector/internal/config"
+	"dark-detector/internal/image"
+)
+
+// calibrateOptions are the flags shared by the calibrate commands.
+type calibrateOptions struct {
+	samples  int
+	interval time.Duration
+	output   string
+}
+
+func parseCalibrateFlags(name string, cfg *config.Config, args []string) (*calibrateOptions, error) {
+	opts := &calibrateOptions{}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.IntVar(&opts.samples, "samples", 5, "frames averaged for every reading")
+	flags.DurationVar(&opts.interval, "interval", 2*time.Second, "delay between frames")
+	flags.StringVar(&opts.output, "output", cfg.CalibrationFile, "calibration file to write")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.output == "" {
+		opts.output = "calibration.json"
+	}
+	if opts.samples < 1 {
+		return nil, fmt.Errorf("samples must be at least 1, got %d", opts.samples)
+	}
+	return opts, nil
+}
+
+// loadCalibrationFile reads the calibration file to update, or starts a new one.
+func loadCalibrationFile(path string) (*calibration.File, error) {
+	f, err := calibration.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		f = &calibration.File{}
+	}
+	return f, nil
+}
+
+// runCalibrate interactively pairs the brightness measured by the camera with
+// readings of a reference lux meter and saves the resulting calibration.
+// A single reading yields a linear scale, more readings a calibration table.
+// The black and white subcommands capture reference frames instead, the day
+// and night subcommands take the readings of the two-point calibration.
+func runCalibrate(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "black", "white":
+			return runCaptureReference(ctx, cfg, args[0], args[1:])
+		case calibration.TwoPointDay, calibration.TwoPointNight:
+			return runTwoPoint(ctx, cfg, args[0], args[1:])
+		}
+	}
+
+	opts, err := parseCalibrateFlags("calibrate", cfg, args)
+	if err != nil {
+		return err
+	}
+	f, err := loadCalibrationFile(opts.output)
+	if err != nil {
+		return err
+	}
+	processor, err := image.NewProcessor(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create image processor: %w", err)
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	points := make([]config.CalibrationPoint, 0)
+	for {
+		fmt.Printf("Reading %d: enter the reference lux, or leave empty to finish: ", len(points)+1)
+		if !input.Scan() {
+			break
+		}
+		line := strings.TrimSpace(input.Text())
+		if line == "" {
+			break
+		}
+		lux, err := strconv.ParseFloat(line, 64)
+		if err != nil || lux < 0 {
+			fmt.Println("Please enter a non-negative number")
+			continue
+		}
+
+		brightness, err := sampleBrightness(ctx, processor, opts.samples, opts.interval)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Measured brightness %.6f for %v lx\n", brightness, lux)
+		points = append(points, config.CalibrationPoint{Brightness: brightness, Lux: lux})
+	}
+
+	f.Scale, f.Table, f.Coefficients = 0, nil, nil
+	switch len(points) {
+	case 0:
+		return fmt.Errorf("no readings were taken")
+	case 1:
+		if points[0].Brightness <= 0 {
+			return fmt.Errorf("the frame is black, take the reading in more light")
+		}
+		f.Curve, f.Scale = config.CurveLinear, points[0].Lux/points[0].Brightness
+	default:
+		f.Curve, f.Table = config.CurveTable, points
+	}
+	if _, err := f.NewCurve(); err != nil {
+		return err
+	}
+	if err := f.Save(opts.output); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %s calibration to %s, set CALIBRATION_FILE to use it\n", f.Curve, opts.output)
+	return nil
+}
+
+// runTwoPoint takes the day or night reading of the two-point calibration and
+// fits a power curve once the other reading was taken as well.
+func runTwoPoint(ctx context.Context, cfg *config.Config, name string, args []string) error {
+	opts, err := parseCalibrateFlags("calibrate "+name, cfg, args)
+	if err != nil {
+		return err
+	}
+	f, err := loadCalibrationFile(opts.output)
+	if err != nil {
+		return err
+	}
+	processor, err := image.NewProcessor(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create image processor: %w", err)
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	var lux float64
+	for {
+		fmt.Printf("Enter the %s reference lux: ", name)
+		if !input.Scan() {
+			return fmt.Errorf("no reading was entered")
+		}
+		lux, err = strconv.ParseFloat(strings.TrimSpace(input.Text()), 64)
+		if err == nil && lux > 0 {
+			break
+		}
+		fmt.Println("Please enter a positive number")
+	}
+
+	brightness, err := sampleBrightness(ctx, processor, opts.samples, opts.interval)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Measured brightness %.6f for %v lx\n", brightness, lux)
+	fitted, err := f.SetTwoPoint(name, config.CalibrationPoint{Brightness: brightness, Lux: lux})
+	if err != nil {
+		return err
+	}
+	if err := f.Save(opts.output); err != nil {
+		return err
+	}
+	if !fitted {
+		other := calibration.TwoPointNight
+		if name == calibration.TwoPointNight {
+			other = calibration.TwoPointDay
+		}
+		fmt.Printf("Saved the %s reading to %s, run \"calibrate %s\" to finish\n", name, opts.output, other)
+		return nil
+	}
+	fmt.Printf("Saved power calibration (a=%.4g, b=%.4g) to %s, set CALIBRATION_FILE to use it\n",
+		f.Coefficients[0], f.Coefficients[1], opts.output)
+	return nil
+}
+
+// runCaptureReference averages several frames into a black (lens covered) or
+// white (evenly lit white target) reference and saves it to the calibration file.
+func runCaptureReference(ctx context.Context, cfg *config.Config, kind string, args []string) error {
+	opts, err := parseCalibrateFlags("calibrate "+kind, cfg, args)
+	if err != nil {
+		return err
+	}
+	f, err := loadCalibrationFile(opts.output)
+	if err != nil {
+		return err
+	}
+	processor, err := image.NewProcessor(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create image processor: %w", err)
+	}
+
+	if kind == "black" {
+		fmt.Print("Cover the lens completely, then press enter: ")
+	} else {
+		fmt.Print("Fill the view with an evenly lit white target, e.g. a diffuser over the lens, then press enter: ")
+	}
+	bufio.NewScanner(os.Stdin).Scan()
+
+	var grid []float64
+	for i := 0; i < opts.samples; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(opts.interval):
+			}
+		}
+		frame, err := processor.CaptureReference(ctx)
+		if err != nil {
+			return err
+		}
+		if grid == nil {
+			grid = make([]float64, len(frame))
+		}
+		for j, v := range frame {
+			grid[j] += v / float64(opts.samples)
+		}
+	}
+
+	width, height := image.ReferenceSize()
+	if f.Reference == nil || f.Reference.Width != width || f.Reference.Height != height {
+		f.Reference = &calibration.Reference{Width: width, Height: height}
+	}
+	if kind == "black" {
+		f.Reference.Black = grid
+	} else {
+		f.Reference.White = grid
+	}
+	if err := f.Save(opts.output); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %s reference to %s, set CALIBRATION_FILE to use it\n", kind, opts.output)
+	return nil
+}
+
+// sampleBrightness averages the brightness of several frames.
+func sampleBrightness(ctx context.Context, processor *image.Processor, samples int, interval time.Duration) (float64, error) {
+	total := 0.0
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		result, err := processor.Process(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if result.IRMode {
+			return 0, fmt.Errorf("the camera is in IR mode, which the calibration doesn't apply to")
+		}
+		total += result.Brightness
+	}
+	return total / float64(samples), nil
+}
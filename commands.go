@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"dark-detector/internal/calibration"
+	"dark-detector/internal/config"
+	"dark-detector/internal/image"
+	"dark-detector/internal/mqtt"
+)
+
+// commandQueueSize bounds the commands waiting for the processing loop.
+const commandQueueSize = 16
+
+// command changes the detector in response to a message from Home Assistant.
+type command func(ctx context.Context) error
+
+// queueCommand hands a command received over MQTT to the processing loop, so
+// detector state is only ever changed from one goroutine. Commands arriving
+// while the queue is full are dropped rather than blocking the MQTT client.
+func (d *detector) queueCommand(name string, c command) {
+	select {
+	case d.commands <- c:
+	default:
+		log.Printf("Dropping %s command, too many commands are pending", name)
+	}
+}
+
+// subscribePollCommand lets Home Assistant take a reading between the
+// scheduled ones, e.g. right before an automation decides on the lights.
+func (d *detector) subscribePollCommand(ctx context.Context) error {
+	return d.publisher.SubscribeAction(ctx, mqtt.ActionPoll, func() {
+		d.queueCommand("poll", func(ctx context.Context) error {
+			if d.paused {
+				log.Println("Ignoring reading request while paused")
+				return nil
+			}
+			log.Println("Taking a reading on request")
+			return d.processAndPublish(ctx)
+		})
+	})
+}
+
+// subscribeImageTopic takes a reading of every image published to topic, for
+// cameras that publish snapshots over MQTT rather than serve them over HTTP.
+func (d *detector) subscribeImageTopic(ctx context.Context, topic string) error {
+	return d.publisher.Subscribe(ctx, topic, func(payload []byte) {
+		d.queueCommand("image", func(ctx context.Context) error {
+			if d.paused {
+				return nil
+			}
+			result, err := d.processor.ProcessImage(payload)
+			if err != nil {
+				// Anyone can publish to the topic, don't stop over a bad message
+				log.Printf("Skipping image from %s: %v", topic, err)
+				return d.recordError(ctx, err)
+			}
+			d.lastImage = payload
+			return d.publishResult(ctx, result)
+		})
+	})
+}
+
+// subscribePauseCommands lets Home Assistant stop and restart the readings,
+// e.g. during camera maintenance or while its privacy mode is on, through the
+// pause and resume topics or the switch entity.
+func (d *detector) subscribePauseCommands(ctx context.Context) error {
+	err := d.publisher.SubscribeAction(ctx, mqtt.ActionPause, func() {
+		d.queueCommand("pause", d.setPaused(true))
+	})
+	if err != nil {
+		return err
+	}
+	err = d.publisher.SubscribeAction(ctx, mqtt.ActionResume, func() {
+		d.queueCommand("resume", d.setPaused(false))
+	})
+	if err != nil {
+		return err
+	}
+	return d.publisher.SubscribeCommand(ctx, mqtt.EntityEnabled, func(value string) {
+		switch value {
+		case mqtt.StateOn:
+			d.queueCommand("resume", d.setPaused(false))
+		case mqtt.StateOff:
+			d.queueCommand("pause", d.setPaused(true))
+		default:
+			log.Printf("Ignoring invalid switch state %q", value)
+		}
+	})
+}
+
+// setPaused returns the command that pauses or resumes the readings.
+func (d *detector) setPaused(paused bool) command {
+	return func(ctx context.Context) error {
+		if paused == d.paused {
+			return nil
+		}
+		if paused {
+			log.Println("Pausing readings")
+		} else {
+			log.Println("Resuming readings")
+		}
+		d.paused = paused
+		d.settings.Paused = &paused
+		return d.publishSetting(ctx, mqtt.EntityEnabled, formatBool(!paused))
+	}
+}
+
+// subscribeCalibrationCommands lets the lux scale, crop and two-point
+// calibration be changed from their entities in Home Assistant.
+func (d *detector) subscribeCalibrationCommands(ctx context.Context) error {
+	err := d.publisher.SubscribeCommand(ctx, mqtt.EntityLuxScale, func(value string) {
+		scale, err := strconv.ParseFloat(value, 64)
+		if err != nil || scale <= 0 {
+			log.Printf("Ignoring invalid lux scale %q", value)
+			return
+		}
+		d.queueCommand("lux scale", func(ctx context.Context) error {
+			log.Printf("Setting lux scale to %v", scale)
+			d.setLuxScale(scale)
+			d.settings.LuxScale = &scale
+			return d.publishSetting(ctx, mqtt.EntityLuxScale, formatFloat(scale))
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = d.publisher.SubscribeCommand(ctx, mqtt.EntityCrop, func(value string) {
+		// An empty value removes the crop
+		crops := config.Crops{}
+		if value != "" {
+			var err error
+			if crops, err = config.ParseCrops(value); err != nil {
+				log.Printf("Ignoring invalid crop %q: %v", value, err)
+				return
+			}
+		}
+		d.queueCommand("crop", d.setCrop(crops))
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, name := range map[string]string{
+		mqtt.EntityCalibrateDay:   calibration.TwoPointDay,
+		mqtt.EntityCalibrateNight: calibration.TwoPointNight,
+	} {
+		err := d.publisher.SubscribeCommand(ctx, key, func(value string) {
+			lux, err := strconv.ParseFloat(value, 64)
+			if err != nil || lux <= 0 {
+				log.Printf("Ignoring invalid %s calibration lux %q", name, value)
+				return
+			}
+			d.queueCommand(name+" calibration", func(ctx context.Context) error {
+				return d.recordTwoPoint(ctx, key, name, lux)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribeCropPresetCommand switches to the crop preset selected in Home
+// Assistant.
+func (d *detector) subscribeCropPresetCommand(ctx context.Context, presets []config.CropPreset) error {
+	return d.publisher.SubscribeCommand(ctx, mqtt.EntityCropPreset, func(value string) {
+		for _, preset := range presets {
+			if preset.Name == value {
+				log.Printf("Switching to crop preset %q", preset.Name)
+				d.queueCommand("crop preset", d.setCrop(preset.Crops))
+				return
+			}
+		}
+		log.Printf("Ignoring unknown crop preset %q", value)
+	})
+}
+
+// subscribeThresholdCommand lets the dark threshold be changed from its
+// number entity in Home Assistant.
+func (d *detector) subscribeThresholdCommand(ctx context.Context) error {
+	return d.publisher.SubscribeCommand(ctx, mqtt.EntityDarkThreshold, func(value string) {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold < 0 {
+			log.Printf("Ignoring invalid dark threshold %q", value)
+			return
+		}
+		d.queueCommand("dark threshold", func(ctx context.Context) error {
+			if d.dark == nil {
+				return nil
+			}
+			log.Printf("Setting dark threshold to %v lx", threshold)
+			d.dark.SetThreshold(threshold)
+			d.settings.DarkThreshold = &threshold
+			return d.publishSetting(ctx, mqtt.EntityDarkThreshold, formatFloat(threshold))
+		})
+	})
+}
+
+// subscribeIntervalCommand lets the time between readings be changed from
+// its number entity in Home Assistant, e.g. to read more often in a storm.
+func (d *detector) subscribeIntervalCommand(ctx context.Context) error {
+	return d.publisher.SubscribeCommand(ctx, mqtt.EntityInterval, func(value string) {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 1 {
+			log.Printf("Ignoring invalid interval %q", value)
+			return
+		}
+		d.queueCommand("interval", func(ctx context.Context) error {
+			interval := int(seconds)
+			log.Printf("Setting interval to %ds", interval)
+			d.setInterval(time.Duration(interval) * time.Second)
+			d.settings.Interval = &interval
+			return d.publishSetting(ctx, mqtt.EntityInterval, strconv.Itoa(interval))
+		})
+	})
+}
+
+// setInterval changes the time between readings, along with how soon an
+// unchanged lux is republished before the states expire.
+func (d *detector) setInterval(interval time.Duration) {
+	d.interval = interval
+	if d.ticker != nil {
+		d.ticker.Reset(interval)
+	}
+	if d.expireCycles > 0 {
+		// Half an interval early, so a late tick doesn't let the state expire
+		d.refreshAfter = time.Duration(d.expireCycles-1)*interval - interval/2
+	}
+	d.publisher.SetInterval(interval)
+}
+
+// setCrop returns the command that changes the crop of the measured frames.
+func (d *detector) setCrop(crops config.Crops) command {
+	return func(ctx context.Context) error {
+		// A crop that fails the readings would also be restored from the
+		// state file on every restart
+		if err := d.processor.CheckCrop(crops); err != nil {
+			log.Printf("Ignoring crop %q: %v", crops, err)
+			return nil
+		}
+		log.Printf("Setting image crop to %q", crops)
+		d.processor.SetCrop(crops)
+		d.settings.ImageCrop = &crops
+		if d.webUI != nil {
+			d.webUI.SetCrop(crops)
+		}
+		return d.publishSetting(ctx, mqtt.EntityCrop, crops.String())
+	}
+}
+
+// cropPreset returns the name of the preset matching the crop in use, or ""
+// when the crop was changed to one that isn't a preset.
+func (d *detector) cropPreset() string {
+	crop := d.processor.Crop().String()
+	for _, preset := range d.cropPresets {
+		if preset.Crops.String() == crop {
+			return preset.Name
+		}
+	}
+	return ""
+}
+
+// recordTwoPoint pairs the reference lux entered in Home Assistant with the
+// brightness of the current frame as the day or night reading of the
+// two-point calibration, and switches to the fitted curve once both are known.
+// When readings are taken as images arrive, the latest image is measured again.
+func (d *detector) recordTwoPoint(ctx context.Context, key, name string, lux float64) error {
+	var result *image.Result
+	var err error
+	switch {
+	case d.ticker != nil:
+		result, err = d.processor.Process(ctx)
+	case d.lastImage != nil:
+		result, err = d.processor.ProcessImage(d.lastImage)
+	default:
+		err = fmt.Errorf("no image has arrived yet")
+	}
+	if err != nil {
+		// Like other bad input, a missed frame shouldn't stop the detector
+		log.Printf("Ignoring %s calibration: %v", name, err)
+		return nil
+	}
+	if result.Blank || result.IRMode {
+		log.Printf("Ignoring %s calibration, the frame is blank or in IR mode", name)
+		return nil
+	}
+
+	f := &calibration.File{}
+	if d.twoPointFile != "" {
+		if f, err = loadCalibrationFile(d.twoPointFile); err != nil {
+			log.Printf("Ignoring %s calibration: %v", name, err)
+			return nil
+		}
+	}
+	// SetTwoPoint replaces the readings instead of changing them, so
+	// d.twoPoint keeps the previous ones until the new reading is accepted
+	f.TwoPoint = d.twoPoint
+	fitted, err := f.SetTwoPoint(name, config.CalibrationPoint{Brightness: result.Brightness, Lux: lux})
+	if err != nil {
+		log.Printf("Ignoring %s calibration: %v", name, err)
+		return nil
+	}
+	if fitted {
+		curve, err := f.NewCurve()
+		if err != nil {
+			log.Printf("Ignoring %s calibration: %v", name, err)
+			return nil
+		}
+		log.Printf("Switching to the power curve fitted to the day and night readings")
+		d.processor.SetCurve(curve)
+		d.settings.LuxScale = nil
+	}
+	d.twoPoint = f.TwoPoint
+	log.Printf("Recorded %s calibration of %v lx at brightness %.6f", name, lux, result.Brightness)
+	if d.twoPointFile != "" {
+		if err := f.Save(d.twoPointFile); err != nil {
+			log.Printf("Failed to save calibration: %v", err)
+		}
+	}
+	return d.publishSetting(ctx, key, formatFloat(lux))
+}
+
+// setLuxScale switches to a linear calibration with the given scale.
+func (d *detector) setLuxScale(scale float64) {
+	d.processor.SetCurve(calibration.Linear{Scale: scale})
+}
+
+// publishSetting confirms a changed setting to Home Assistant and saves it.
+func (d *detector) publishSetting(ctx context.Context, key string, value string) error {
+	if d.stateFile != "" {
+		d.saveState()
+	}
+	return d.publisher.PublishState(ctx, key, value)
+}
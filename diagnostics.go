@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"dark-detector/internal/image"
+	"dark-detector/internal/mqtt"
+)
+
+// maxErrorLength keeps the last error within the 255 characters Home
+// Assistant allows for a state.
+const maxErrorLength = 255
+
+// diagnostics are extra attributes of the lux sensor that help tell why a
+// reading looks wrong, published next to the other attributes.
+type diagnostics struct {
+	sourceHost  string // host of the image URL, without credentials or path
+	blankFrames int    // frames skipped as blank since the start
+}
+
+func newDiagnostics(imageURL string) *diagnostics {
+	g := &diagnostics{}
+	if u, err := url.Parse(imageURL); err == nil {
+		g.sourceHost = u.Host
+	}
+	return g
+}
+
+// addAttributes adds the diagnostics of the latest reading to attributes.
+func (g *diagnostics) addAttributes(attributes map[string]interface{}, d *detector, result *image.Result) {
+	attributes["frame_time"] = result.FrameTime.Format(time.RFC3339)
+	attributes["source_host"] = g.sourceHost
+	attributes["crop"] = d.processor.Crop().String()
+	attributes["blank_frames"] = g.blankFrames
+	attributes["download_errors"] = d.processor.DownloadErrors()
+	attributes["publish_errors"] = d.publisher.PublishErrors()
+}
+
+// recordError keeps why a reading was skipped for the diagnostics and
+// publishes it to the last error sensor.
+func (d *detector) recordError(ctx context.Context, err error) error {
+	d.lastError = err.Error()
+	if len(d.lastError) > maxErrorLength {
+		d.lastError = d.lastError[:maxErrorLength]
+	}
+	return d.publisher.PublishState(ctx, mqtt.EntityLastError, d.lastError)
+}
+
+// runDiagnostics publishes the runtime stats of the detector every interval
+// until ctx is done. Publishing runs on the processing loop, which owns the
+// stats.
+func (d *detector) runDiagnostics(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.queueCommand("diagnostics", d.publishDiagnostics)
+		}
+	}
+}
+
+// publishDiagnostics publishes the runtime stats of the detector.
+func (d *detector) publishDiagnostics(ctx context.Context) error {
+	return d.publisher.PublishDiagnostics(ctx, mqtt.DiagnosticsPayload{
+		Uptime:          int64(time.Since(d.started).Seconds()),
+		Cycles:          d.cycles,
+		FrameAge:        d.frameAge,
+		FetchFailures:   d.processor.DownloadErrors(),
+		DecodeFailures:  d.processor.DecodeErrors(),
+		PublishFailures: d.publisher.PublishErrors(),
+		LastError:       d.lastError,
+	})
+}
@@ -0,0 +1,154 @@
+package calibration
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dark-detector/internal/config"
+)
+
+// Auto-calibration parameters
+const (
+	referenceMaxAge = 5 * time.Minute // how long a reference reading pairs with frames
+	maxSamples      = 10000           // samples kept, the oldest are dropped first
+	binsPerDecade   = 4               // resolution of the fitted table in brightness
+	minBinSamples   = 3               // samples needed for a bin to become a table point
+	minBins         = 2
+	refitEvery      = 10 // samples between refits once the minimum is reached
+)
+
+// Auto pairs the brightness of frames with readings of a real lux sensor and
+// fits a calibration table to them. The table has a point for every band of
+// brightness with enough samples, taken as the median of the samples in it,
+// so outliers such as a passing car barely move it.
+type Auto struct {
+	minSamples int
+
+	mu            sync.Mutex
+	reference     float64
+	referenceTime time.Time
+
+	samples    []config.CalibrationPoint
+	sinceRefit int
+	table      *Table // the last fitted table, nil until one is fitted
+}
+
+// NewAuto creates an auto-calibration that fits a curve once minSamples
+// paired samples have been collected.
+func NewAuto(minSamples int) *Auto {
+	return &Auto{minSamples: minSamples}
+}
+
+// SetReference records a reading of the reference sensor. It is safe to call
+// from another goroutine.
+func (a *Auto) SetReference(lux float64, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reference = lux
+	a.referenceTime = now
+}
+
+// Add pairs the brightness of a frame with the latest reference reading and
+// returns a newly fitted curve, or nil when the curve wasn't refitted.
+func (a *Auto) Add(brightness float64, now time.Time) Curve {
+	a.mu.Lock()
+	reference, referenceTime := a.reference, a.referenceTime
+	a.mu.Unlock()
+	if referenceTime.IsZero() || now.Sub(referenceTime) > referenceMaxAge || brightness <= 0 {
+		return nil
+	}
+
+	a.samples = append(a.samples, config.CalibrationPoint{Brightness: brightness, Lux: reference})
+	if len(a.samples) > maxSamples {
+		a.samples = a.samples[len(a.samples)-maxSamples:]
+	}
+	a.sinceRefit++
+	if len(a.samples) < a.minSamples || (a.sinceRefit < refitEvery && len(a.samples) > a.minSamples) {
+		return nil
+	}
+	a.sinceRefit = 0
+
+	table, err := NewTable(a.fit())
+	if err != nil {
+		// Not enough spread in brightness yet
+		return nil
+	}
+	a.table = table
+	return table
+}
+
+// Restore continues from samples collected earlier, e.g. before a restart.
+func (a *Auto) Restore(samples []config.CalibrationPoint, table *Table) {
+	a.samples = append(samples[:0:0], samples...)
+	a.table = table
+}
+
+// Samples returns the samples collected so far.
+func (a *Auto) Samples() []config.CalibrationPoint {
+	return a.samples
+}
+
+// Table returns the last fitted table, or nil when none was fitted yet.
+func (a *Auto) Table() *Table {
+	return a.table
+}
+
+// fit groups the samples into logarithmic brightness bins and returns the
+// median brightness and lux of every bin with enough samples.
+func (a *Auto) fit() []config.CalibrationPoint {
+	bins := make(map[int][]config.CalibrationPoint)
+	for _, s := range a.samples {
+		bin := int(math.Floor(math.Log10(s.Brightness) * binsPerDecade))
+		bins[bin] = append(bins[bin], s)
+	}
+
+	points := make([]config.CalibrationPoint, 0, len(bins))
+	for _, samples := range bins {
+		if len(samples) < minBinSamples {
+			continue
+		}
+		brightness := make([]float64, len(samples))
+		lux := make([]float64, len(samples))
+		for i, s := range samples {
+			brightness[i], lux[i] = s.Brightness, s.Lux
+		}
+		points = append(points, config.CalibrationPoint{Brightness: median(brightness), Lux: median(lux)})
+	}
+	if len(points) < minBins {
+		return nil
+	}
+	return points
+}
+
+// ParseReference reads a lux value from a reference sensor message, either a
+// plain number or a JSON object holding the number under key.
+func ParseReference(payload []byte, key string) (float64, error) {
+	if lux, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64); err == nil {
+		return lux, nil
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return 0, fmt.Errorf("reference is neither a number nor a JSON object: %w", err)
+	}
+	lux, ok := values[key].(float64)
+	if !ok {
+		return 0, fmt.Errorf("reference has no numeric %q field", key)
+	}
+	return lux, nil
+}
+
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
@@ -0,0 +1,144 @@
+package calibration
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"dark-detector/internal/config"
+)
+
+// Curve maps the average linear brightness of a frame (0-1) to lux.
+type Curve interface {
+	Lux(brightness float64) float64
+}
+
+// New creates the calibration curve from the calibration file when it holds
+// one, or else the curve selected in the configuration. f may be nil.
+func New(cfg *config.Config, f *File) (Curve, error) {
+	if f != nil && f.Curve != "" {
+		return f.NewCurve()
+	}
+
+	switch cfg.CalibrationCurve {
+	case config.CurveLinear:
+		return Linear{Scale: cfg.LuxScale}, nil
+	case config.CurveTable:
+		return NewTable(cfg.CalibrationTable)
+	case config.CurvePower:
+		return newPower(cfg.CalibrationCoefficients)
+	case config.CurveLog:
+		return newLog(cfg.CalibrationCoefficients)
+	default:
+		return nil, fmt.Errorf("unknown calibration curve %q", cfg.CalibrationCurve)
+	}
+}
+
+// Linear scales brightness by a single factor.
+type Linear struct {
+	Scale float64
+}
+
+func (l Linear) Lux(brightness float64) float64 {
+	return brightness * l.Scale
+}
+
+// Power maps brightness with a power law, lux = A·brightness^B, which follows
+// cameras whose auto gain compresses bright scenes.
+type Power struct {
+	A, B float64
+}
+
+func newPower(coefficients []float64) (Power, error) {
+	if len(coefficients) != 2 {
+		return Power{}, fmt.Errorf("a power curve needs two coefficients, got %d", len(coefficients))
+	}
+	return Power{A: coefficients[0], B: coefficients[1]}, nil
+}
+
+func (p Power) Lux(brightness float64) float64 {
+	if brightness <= 0 {
+		return 0
+	}
+	return p.A * math.Pow(brightness, p.B)
+}
+
+// Log maps brightness logarithmically, lux = A + B·log10(brightness),
+// clamped at 0 lx.
+type Log struct {
+	A, B float64
+}
+
+func newLog(coefficients []float64) (Log, error) {
+	if len(coefficients) != 2 {
+		return Log{}, fmt.Errorf("a log curve needs two coefficients, got %d", len(coefficients))
+	}
+	return Log{A: coefficients[0], B: coefficients[1]}, nil
+}
+
+func (l Log) Lux(brightness float64) float64 {
+	if brightness <= 0 {
+		return 0
+	}
+	return math.Max(l.A+l.B*math.Log10(brightness), 0)
+}
+
+// Scaled multiplies the lux of a curve by a factor.
+type Scaled struct {
+	Curve  Curve
+	Factor float64
+}
+
+func (s Scaled) Lux(brightness float64) float64 {
+	return s.Curve.Lux(brightness) * s.Factor
+}
+
+// Table interpolates linearly between measured brightness/lux pairs, so the
+// output can match a reference meter at several light levels. Below the first
+// point it scales towards 0 lx at 0 brightness, above the last point it
+// extends the slope of the last segment.
+type Table struct {
+	points []config.CalibrationPoint
+}
+
+// NewTable creates a table curve from at least two points.
+func NewTable(points []config.CalibrationPoint) (*Table, error) {
+	if len(points) < 2 {
+		return nil, fmt.Errorf("a calibration table needs at least two points, got %d", len(points))
+	}
+	sorted := append([]config.CalibrationPoint(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Brightness < sorted[j].Brightness })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Brightness == sorted[i-1].Brightness {
+			return nil, fmt.Errorf("duplicate calibration point for brightness %v", sorted[i].Brightness)
+		}
+	}
+	return &Table{points: sorted}, nil
+}
+
+// Points returns the points of the table ordered by brightness.
+func (t *Table) Points() []config.CalibrationPoint {
+	return t.points
+}
+
+func (t *Table) Lux(brightness float64) float64 {
+	first := t.points[0]
+	if brightness <= first.Brightness {
+		if first.Brightness <= 0 {
+			return first.Lux
+		}
+		return brightness / first.Brightness * first.Lux
+	}
+
+	// The segment containing the brightness, or the last one to extrapolate
+	i := sort.Search(len(t.points), func(i int) bool { return t.points[i].Brightness >= brightness })
+	if i == len(t.points) {
+		i = len(t.points) - 1
+	}
+	lo, hi := t.points[i-1], t.points[i]
+	lux := lo.Lux + (brightness-lo.Brightness)/(hi.Brightness-lo.Brightness)*(hi.Lux-lo.Lux)
+	if lux < 0 {
+		return 0
+	}
+	return lux
+}
@@ -0,0 +1,110 @@
+package calibration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"dark-detector/internal/config"
+)
+
+// File holds calibration parameters saved by the calibrate command. When
+// present it takes precedence over the curve in the environment.
+type File struct {
+	Curve string                    `json:"curve"`
+	Scale float64                   `json:"scale,omitempty"`
+	Table []config.CalibrationPoint `json:"table,omitempty"`
+	// Coefficients a and b of a power or log curve
+	Coefficients []float64 `json:"coefficients,omitempty"`
+	// Reference holds the black level and white point of the camera, nil until captured
+	Reference *Reference `json:"reference,omitempty"`
+	// TwoPoint holds the readings of the two-point calibration, nil until one is taken
+	TwoPoint *TwoPoint `json:"two_point,omitempty"`
+}
+
+// Reference holds grids of the average linear luminance (0-1) of a covered
+// lens (Black) and an evenly lit white target (White), each Width by Height
+// cells over the measured frame. Either grid may be empty.
+type Reference struct {
+	Width  int       `json:"width"`
+	Height int       `json:"height"`
+	Black  []float64 `json:"black,omitempty"`
+	White  []float64 `json:"white,omitempty"`
+}
+
+// LoadFile reads a calibration file. It returns nil without error when the
+// file doesn't exist.
+func LoadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read calibration file: %w", err)
+	}
+
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse calibration file: %w", err)
+	}
+	return &f, nil
+}
+
+// Save writes the calibration file.
+func (f *File) Save(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal calibration file: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write calibration file: %w", err)
+	}
+	return nil
+}
+
+// SetTwoPoint records a reading of the two-point calibration. Once both
+// readings are known the curve is replaced by a power curve fitted to them,
+// which is reported by returning true. A reading that fails leaves the file
+// as it was, and TwoPoint is replaced rather than changed, so callers holding
+// the previous readings keep them.
+func (f *File) SetTwoPoint(name string, point config.CalibrationPoint) (bool, error) {
+	var twoPoint TwoPoint
+	if f.TwoPoint != nil {
+		twoPoint = *f.TwoPoint
+	}
+	if err := twoPoint.Set(name, point); err != nil {
+		return false, err
+	}
+	if !twoPoint.Complete() {
+		f.TwoPoint = &twoPoint
+		return false, nil
+	}
+	power, err := twoPoint.Fit()
+	if err != nil {
+		return false, err
+	}
+	f.TwoPoint = &twoPoint
+	f.Curve, f.Scale, f.Table = config.CurvePower, 0, nil
+	f.Coefficients = []float64{power.A, power.B}
+	return true, nil
+}
+
+// NewCurve creates the curve described by the file.
+func (f *File) NewCurve() (Curve, error) {
+	switch f.Curve {
+	case config.CurveLinear:
+		if f.Scale <= 0 {
+			return nil, fmt.Errorf("calibration file has no positive scale")
+		}
+		return Linear{Scale: f.Scale}, nil
+	case config.CurveTable:
+		return NewTable(f.Table)
+	case config.CurvePower:
+		return newPower(f.Coefficients)
+	case config.CurveLog:
+		return newLog(f.Coefficients)
+	default:
+		return nil, fmt.Errorf("unknown calibration curve %q", f.Curve)
+	}
+}
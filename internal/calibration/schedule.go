@@ -0,0 +1,37 @@
+package calibration
+
+import (
+	"sort"
+	"time"
+
+	"dark-detector/internal/config"
+)
+
+// Schedule switches between calibration factors by time of day, since IR
+// illumination and auto-exposure at night can make a single calibration wrong
+// by an order of magnitude.
+type Schedule struct {
+	entries []config.ScheduleEntry
+}
+
+// NewSchedule creates a schedule from entries that each apply from their start
+// time until the next entry starts, wrapping around midnight.
+func NewSchedule(entries []config.ScheduleEntry) *Schedule {
+	sorted := append([]config.ScheduleEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Minute < sorted[j].Minute })
+	return &Schedule{entries: sorted}
+}
+
+// Factor returns the calibration factor in effect at the given local time.
+func (s *Schedule) Factor(t time.Time) float64 {
+	minute := t.Hour()*60 + t.Minute()
+	// Before the first entry of the day the last one is still in effect
+	factor := s.entries[len(s.entries)-1].Factor
+	for _, entry := range s.entries {
+		if entry.Minute > minute {
+			break
+		}
+		factor = entry.Factor
+	}
+	return factor
+}
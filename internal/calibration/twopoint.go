@@ -0,0 +1,59 @@
+package calibration
+
+import (
+	"fmt"
+	"math"
+
+	"dark-detector/internal/config"
+)
+
+// Readings of the two-point calibration
+const (
+	TwoPointDay   = "day"
+	TwoPointNight = "night"
+)
+
+// TwoPoint holds a daytime and a nighttime reading of a reference meter. The
+// readings are usually taken hours apart, so each is kept until the other
+// one is recorded.
+type TwoPoint struct {
+	Day   *config.CalibrationPoint `json:"day,omitempty"`
+	Night *config.CalibrationPoint `json:"night,omitempty"`
+}
+
+// Set records the named reading.
+func (t *TwoPoint) Set(name string, point config.CalibrationPoint) error {
+	if point.Brightness <= 0 || point.Lux <= 0 {
+		return fmt.Errorf("the %s reading needs some light, got %v lx at brightness %v", name, point.Lux, point.Brightness)
+	}
+	switch name {
+	case TwoPointDay:
+		t.Day = &point
+	case TwoPointNight:
+		t.Night = &point
+	default:
+		return fmt.Errorf("unknown two-point reading %q", name)
+	}
+	return nil
+}
+
+// Complete reports whether both readings are known.
+func (t *TwoPoint) Complete() bool {
+	return t.Day != nil && t.Night != nil
+}
+
+// Fit returns the power curve passing through both readings. A straight line
+// in log-log space covers the wide range between day and night better than
+// a linear scale.
+func (t *TwoPoint) Fit() (Power, error) {
+	if !t.Complete() {
+		return Power{}, fmt.Errorf("the two-point calibration needs a day and a night reading")
+	}
+	day, night := *t.Day, *t.Night
+	if day.Brightness <= night.Brightness || day.Lux <= night.Lux {
+		return Power{}, fmt.Errorf("the day reading must be brighter than the night reading")
+	}
+	b := math.Log(day.Lux/night.Lux) / math.Log(day.Brightness/night.Brightness)
+	a := day.Lux / math.Pow(day.Brightness, b)
+	return Power{A: a, B: b}, nil
+}
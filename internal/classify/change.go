@@ -0,0 +1,65 @@
+package classify
+
+import "math"
+
+// Types of the events reported by Change.
+const (
+	EventSuddenDarkening   = "sudden_darkening"
+	EventSuddenBrightening = "sudden_brightening"
+	EventIRModeOn          = "ir_mode_on"
+	EventIRModeOff         = "ir_mode_off"
+)
+
+// ChangeEvents lists the type of every event Change reports.
+var ChangeEvents = []string{EventSuddenDarkening, EventSuddenBrightening, EventIRModeOn, EventIRModeOff}
+
+// Event is a transition between two consecutive readings.
+type Event struct {
+	Type    string
+	FromLux float64
+	ToLux   float64
+}
+
+// Change detects sudden transitions between consecutive readings, such as a
+// light switched on in view of the camera or the camera switching to IR.
+type Change struct {
+	ratio     float64 // share of the last lux a reading must move by
+	minChange float64 // lux a reading must move by, so noise in the dark isn't sudden
+	lastLux   float64
+	lastIR    bool
+	started   bool
+}
+
+// NewChange creates a detector reporting readings that moved by at least
+// percent of the last one and by at least minChange lux.
+func NewChange(percent, minChange float64) *Change {
+	return &Change{
+		ratio:     percent / 100,
+		minChange: minChange,
+	}
+}
+
+// Update adds a reading and returns the events it caused, if any.
+func (c *Change) Update(lux float64, irMode bool) []Event {
+	var events []Event
+	if c.started {
+		event := Event{FromLux: c.lastLux, ToLux: lux}
+		delta := lux - c.lastLux
+		if math.Abs(delta) >= c.minChange && math.Abs(delta) >= c.ratio*c.lastLux {
+			event.Type = EventSuddenBrightening
+			if delta < 0 {
+				event.Type = EventSuddenDarkening
+			}
+			events = append(events, event)
+		}
+		if irMode != c.lastIR {
+			event.Type = EventIRModeOff
+			if irMode {
+				event.Type = EventIRModeOn
+			}
+			events = append(events, event)
+		}
+	}
+	c.lastLux, c.lastIR, c.started = lux, irMode, true
+	return events
+}
@@ -0,0 +1,60 @@
+package classify
+
+import "time"
+
+// Dark decides whether a scene is dark using separate on and off thresholds
+// (hysteresis) and a minimum dwell time, so readings hovering around a single
+// threshold don't flip the state back and forth.
+type Dark struct {
+	onThreshold  float64
+	offThreshold float64
+	minDwell     time.Duration
+	dark         bool
+	pendingSince time.Time
+	started      bool
+}
+
+// NewDark creates a classifier that turns dark at or below onThreshold and
+// light again at or above offThreshold, once the condition has held for minDwell.
+func NewDark(onThreshold, offThreshold float64, minDwell time.Duration) *Dark {
+	return &Dark{
+		onThreshold:  onThreshold,
+		offThreshold: offThreshold,
+		minDwell:     minDwell,
+	}
+}
+
+// Update adds a reading taken at the given time and returns whether it is dark.
+func (d *Dark) Update(lux float64, now time.Time) bool {
+	if !d.started {
+		d.dark = lux <= d.onThreshold
+		d.started = true
+		return d.dark
+	}
+
+	wantChange := (!d.dark && lux <= d.onThreshold) || (d.dark && lux >= d.offThreshold)
+	if !wantChange {
+		d.pendingSince = time.Time{}
+		return d.dark
+	}
+
+	if d.pendingSince.IsZero() {
+		d.pendingSince = now
+	}
+	if now.Sub(d.pendingSince) >= d.minDwell {
+		d.dark = !d.dark
+		d.pendingSince = time.Time{}
+	}
+	return d.dark
+}
+
+// Thresholds returns the on and off thresholds.
+func (d *Dark) Thresholds() (on, off float64) {
+	return d.onThreshold, d.offThreshold
+}
+
+// SetThreshold moves the on threshold, keeping the gap to the off threshold.
+func (d *Dark) SetThreshold(on float64) {
+	d.offThreshold += on - d.onThreshold
+	d.onThreshold = on
+}
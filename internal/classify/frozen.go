@@ -0,0 +1,34 @@
+package classify
+
+import "math/bits"
+
+// Frozen detects a camera feed that keeps returning the same frame by
+// comparing perceptual hashes of consecutive frames.
+type Frozen struct {
+	maxDistance int
+	cycles      int
+	last        uint64
+	repeats     int
+	started     bool
+}
+
+// NewFrozen creates a detector that reports the feed frozen once the hash has
+// stayed within maxDistance differing bits for the given number of cycles.
+func NewFrozen(maxDistance, cycles int) *Frozen {
+	return &Frozen{
+		maxDistance: maxDistance,
+		cycles:      cycles,
+	}
+}
+
+// Update adds the hash of the latest frame and returns whether the feed is frozen.
+func (f *Frozen) Update(hash uint64) bool {
+	if f.started && bits.OnesCount64(hash^f.last) <= f.maxDistance {
+		f.repeats++
+	} else {
+		f.repeats = 0
+	}
+	f.last = hash
+	f.started = true
+	return f.repeats >= f.cycles
+}
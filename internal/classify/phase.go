@@ -0,0 +1,23 @@
+package classify
+
+import "dark-detector/internal/config"
+
+// Phase classifies readings into named lux bands such as night, dusk and day.
+type Phase struct {
+	bands []config.Band
+}
+
+// NewPhase creates a classifier over bands ordered from darkest to brightest.
+func NewPhase(bands []config.Band) *Phase {
+	return &Phase{bands: bands}
+}
+
+// Classify returns the name of the band the reading falls into.
+func (p *Phase) Classify(lux float64) string {
+	for _, band := range p.bands {
+		if lux < band.Upper {
+			return band.Name
+		}
+	}
+	return p.bands[len(p.bands)-1].Name
+}
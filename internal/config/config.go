@@ -2,95 +2,1413 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Outputs that can be selected with the OUTPUTS environment variable.
+const (
+	OutputLux        = "lux"
+	OutputLightness  = "lightness"
+	OutputEV         = "ev"
+	OutputLog10      = "log10"
+	OutputBrightness = "brightness"
+)
+
+// Smoothing modes that can be selected with the SMOOTHING environment variable.
+const (
+	SmoothingNone   = "none"
+	SmoothingEMA    = "ema"
+	SmoothingMedian = "median"
+	SmoothingKalman = "kalman"
+)
+
+// Suffixes of the MQTT client ID that can be selected with the
+// MQTT_CLIENT_ID_SUFFIX environment variable.
+const (
+	ClientIDSuffixNone     = "none"
+	ClientIDSuffixHostname = "hostname"
+	ClientIDSuffixRandom   = "random"
+)
+
+// Formats of the Home Assistant discovery configs that can be selected with
+// the HASS_DISCOVERY_FORMAT environment variable.
+const (
+	DiscoveryFormatEntity = "entity"
+	DiscoveryFormatDevice = "device"
+)
+
+// Calibration curves that can be selected with the CALIBRATION_CURVE environment variable.
+const (
+	CurveLinear = "linear"
+	CurveTable  = "table"
+	CurvePower  = "power"
+	CurveLog    = "log"
+)
+
+// CalibrationPoint pairs the average linear brightness of a frame (0-1) with
+// the lux measured by a reference meter at the same time.
+type CalibrationPoint struct {
+	Brightness float64 `json:"brightness"`
+	Lux        float64 `json:"lux"`
+}
+
+// ScheduleEntry is a calibration factor that applies from a time of day,
+// in minutes after midnight, until the next entry starts.
+type ScheduleEntry struct {
+	Minute int
+	Factor float64
+}
+
+// Band is a named lux range used for scene classification. A reading belongs
+// to the first band whose Upper bound it is below; the last band is unbounded.
+type Band struct {
+	Name  string
+	Upper float64
+}
+
+// Region is a named rectangle of the frame, in full image coordinates,
+// whose lux is published as a separate sensor.
+type Region struct {
+	Name   string
+	Crop   Crop    // x, y, width, height
+	Weight float64 // share of the combined lux, 0 when the region is not part of it
+}
+
+// CropPreset is a named crop that can be switched to from Home Assistant.
+type CropPreset struct {
+	Name  string
+	Crops Crops // empty to measure the whole frame
+}
+
 // Config holds the configuration for the application.
 type Config struct {
-	Interval                 int
-	ImageURL                 string
-	ImageCrop                *[]int
-	MQTTHost                 string
-	MQTTTopic                string
-	MQTTClientID             string
-	MQTTUsername             string
-	MQTTPassword             string
-	HASSAutoDiscoveryEnabled bool
-	HASSAutoDiscoveryTopic   string
-	HASSName                 string
+	Interval                   int
+	IntervalEntityEnabled      bool
+	ExpireAfterCycles          int
+	ImageURL                   string
+	ImageTopic                 string
+	ImageUsername              string
+	ImagePassword              string
+	ImageCrop                  Crops
+	CropPresets                []CropPreset
+	ImageMask                  string
+	ImageExclude               Crops
+	WebUIAddress               string
+	PreviewFile                string
+	ImageEntityEnabled         bool
+	CameraEntityEnabled        bool
+	CameraEntityQuality        int
+	CameraEntityInterval       int
+	AnnotatedEntityEnabled     bool
+	AnnotatedEntityInterval    int
+	SwitchEntityEnabled        bool
+	ButtonEntityEnabled        bool
+	Downscale                  int
+	ImageRotation              int
+	ImageFlip                  string
+	EXIFOrientationEnabled     bool
+	Regions                    []Region
+	LuxTrimPercent             float64
+	LuxClipThreshold           float64
+	LuxScale                   float64
+	CalibrationCurve           string
+	CalibrationTable           []CalibrationPoint
+	CalibrationCoefficients    []float64
+	CalibrationFile            string
+	CalibrationSchedule        []ScheduleEntry
+	ReferenceTopic             string
+	ReferenceKey               string
+	ReferenceMinSamples        int
+	TransferFunction           string
+	TransferGamma              float64
+	LumaCoefficients           string
+	MeteringMode               string
+	MeteringSpotSize           float64
+	EXIFExposureEnabled        bool
+	IRModeEnabled              bool
+	IRChromaThreshold          float64
+	IRLuxScale                 float64
+	ColorTemperatureEnabled    bool
+	DominantColorEnabled       bool
+	FrozenDetectionEnabled     bool
+	SharpnessEnabled           bool
+	NoiseEnabled               bool
+	BlankFrameThreshold        float64
+	DarkPixelsEnabled          bool
+	DarkPixelThreshold         float64
+	MotionEnabled              bool
+	MotionPixelThreshold       float64
+	MotionRatioThreshold       float64
+	FrozenHashDistance         int
+	FrozenFrameCycles          int
+	EventsEnabled              bool
+	EventChangePercent         float64
+	EventMinChange             float64
+	HistogramEnabled           bool
+	HistogramBuckets           int
+	LuminanceStatsEnabled      bool
+	Outputs                    []string
+	Smoothing                  string
+	SmoothingAlpha             float64
+	SmoothingWindow            int
+	KalmanProcessNoise         float64
+	KalmanMeasurementNoise     float64
+	SmoothingRawAttribute      bool
+	MaxStep                    float64
+	DeadBand                   float64
+	DeadBandPercent            float64
+	DarkEnabled                bool
+	DarkThresholdOn            float64
+	DarkThresholdOff           float64
+	DarkMinDwell               int
+	DarkDeviceClass            string
+	ThresholdEntityEnabled     bool
+	ClassificationEnabled      bool
+	ClassificationBands        []Band
+	TrendEnabled               bool
+	TrendWindow                int
+	AggregateEnabled           bool
+	AggregateWindow            int
+	SolarCheckEnabled          bool
+	Latitude                   float64
+	Longitude                  float64
+	SolarLuxMargin             float64
+	SolarClampEnabled          bool
+	StateFile                  string
+	CalibrationEntitiesEnabled bool
+	MQTTHosts                  []string // broker URLs, the first is preferred, empty to discover one over mDNS
+	MQTTFailbackInterval       int
+	MQTTBufferSize             int
+	MQTTCleanSession           bool
+	MQTTKeepAlive              int
+	MQTTConnectTimeout         int
+	MQTTPublishTimeout         int
+	MQTTPublishRetries         int
+	MQTTMaxReconnectInterval   int
+	MQTTConnectRetryInterval   int
+	MQTTTopic                  string
+	MQTTClientID               string
+	MQTTClientIDSuffix         string
+	MQTTUsername               string
+	MQTTPassword               string
+	MQTTProtocolVersion        uint // 3 for MQTT 3.1, 4 for 3.1.1, 5 for MQTT 5, 0 to negotiate 3.1.1 or 3.1
+	MQTTSessionExpiry          int  // seconds the broker keeps the session after a disconnect, MQTT 5 only
+	MQTTMessageExpiry          int  // seconds the broker keeps a lux state, 0 to keep it, MQTT 5 only
+	MQTTTLSEnabled             bool
+	MQTTCAFile                 string
+	MQTTClientCertFile         string
+	MQTTClientKeyFile          string
+	MQTTTLSInsecure            bool
+	MQTTStateQoS               byte
+	MQTTStateRetain            bool
+	MQTTStateRestoreEnabled    bool
+	MQTTStateJSONEnabled       bool
+	DiagnosticsEnabled         bool
+	DiagnosticsInterval        int
+	DiagnosticEntitiesEnabled  bool
+	LastErrorEnabled           bool
+	MQTTAvailabilityQoS        byte
+	MQTTAvailabilityRetain     bool
+	MQTTDiscoveryQoS           byte
+	MQTTDiscoveryRetain        bool
+	HASSAutoDiscoveryEnabled   bool
+	HASSAutoDiscoveryTopic     string
+	HASSDiscoveryTopic         string // template of discovery topics
+	HASSDiscoveryFormat        string
+	HASSForceUpdate            bool
+	MQTTBaseTopic              string // template of the topic entity states are published under
+	MQTTStateTopic             string // template of the lux state topic
+	MQTTAvailabilityTopic      string // template of the availability topic
+	MQTTStatusTopic            string // template of the shared status topic, empty when not used
+	MQTTCameraTopic            string // template of the camera availability topic, empty when not used
+	MQTTPayloadAvailable       string
+	MQTTPayloadNotAvailable    string
+	HASSName                   string
+	HASSDeviceName             string // template of the Home Assistant device name
+	HASSSuggestedArea          string // template of the area suggested for the device
+	HASSConfigurationURL       string
+	HASSViaDevice              string
+	HASSIcons                  map[string]string // by entity key, "lux" for the lux sensor
+	HASSDeviceClasses          map[string]string // by entity key, "lux" for the lux sensor
 }
 
 // Load initializes the configuration by loading environment variables and setting up the MQTT client.
 func Load() (*Config, error) {
 	envVars := map[string]*string{
-		"IMAGE_URL":                   nil,
-		"INTERVAL":                    &[]string{"60"}[0],
-		"MQTT_HOST":                   nil,
-		"MQTT_TOPIC":                  &[]string{"darkdetector"}[0],
-		"MQTT_CLIENT_ID":              &[]string{"darkdetector"}[0],
-		"HASS_AUTO_DISCOVERY_ENABLED": &[]string{"true"}[0],
-		"HASS_AUTO_DISCOVERY_TOPIC":   &[]string{"homeassistant"}[0],
-		"HASS_NAME":                   &[]string{"Light Sensor"}[0],
+		"IMAGE_URL":                    &[]string{""}[0],
+		"IMAGE_TOPIC":                  &[]string{""}[0],
+		"IMAGE_USERNAME":               &[]string{""}[0],
+		"IMAGE_PASSWORD":               &[]string{""}[0],
+		"INTERVAL":                     &[]string{"60"}[0],
+		"INTERVAL_ENTITY_ENABLED":      &[]string{"false"}[0],
+		"EXPIRE_AFTER_CYCLES":          &[]string{"0"}[0],
+		"LUX_TRIM_PERCENT":             &[]string{"0"}[0],
+		"LUX_CLIP_THRESHOLD":           &[]string{"0"}[0],
+		"LUX_SCALE":                    &[]string{"9500"}[0],
+		"CALIBRATION_CURVE":            &[]string{CurveLinear}[0],
+		"CALIBRATION_TABLE":            &[]string{""}[0],
+		"CALIBRATION_COEFFICIENTS":     &[]string{""}[0],
+		"IMAGE_MASK":                   &[]string{""}[0],
+		"CALIBRATION_FILE":             &[]string{""}[0],
+		"WEB_UI_ADDRESS":               &[]string{""}[0],
+		"PREVIEW_FILE":                 &[]string{""}[0],
+		"IMAGE_ENTITY_ENABLED":         &[]string{"false"}[0],
+		"CAMERA_ENTITY_ENABLED":        &[]string{"false"}[0],
+		"CAMERA_ENTITY_QUALITY":        &[]string{"75"}[0],
+		"CAMERA_ENTITY_INTERVAL":       &[]string{"0"}[0],
+		"ANNOTATED_ENTITY_ENABLED":     &[]string{"false"}[0],
+		"ANNOTATED_ENTITY_INTERVAL":    &[]string{"0"}[0],
+		"SWITCH_ENTITY_ENABLED":        &[]string{"false"}[0],
+		"BUTTON_ENTITY_ENABLED":        &[]string{"false"}[0],
+		"DOWNSCALE":                    &[]string{"1"}[0],
+		"IMAGE_ROTATION":               &[]string{"0"}[0],
+		"IMAGE_FLIP":                   &[]string{"none"}[0],
+		"EXIF_ORIENTATION_ENABLED":     &[]string{"true"}[0],
+		"CALIBRATION_PROFILE":          &[]string{""}[0],
+		"CALIBRATION_SCHEDULE":         &[]string{""}[0],
+		"REFERENCE_TOPIC":              &[]string{""}[0],
+		"REFERENCE_KEY":                &[]string{"illuminance"}[0],
+		"REFERENCE_MIN_SAMPLES":        &[]string{"100"}[0],
+		"TRANSFER_FUNCTION":            &[]string{"srgb"}[0],
+		"TRANSFER_GAMMA":               &[]string{"2.2"}[0],
+		"LUMA_COEFFICIENTS":            &[]string{"bt709"}[0],
+		"METERING_MODE":                &[]string{"average"}[0],
+		"METERING_SPOT_SIZE":           &[]string{"10"}[0],
+		"EXIF_EXPOSURE_ENABLED":        &[]string{"false"}[0],
+		"IR_MODE_ENABLED":              &[]string{"false"}[0],
+		"IR_CHROMA_THRESHOLD":          &[]string{"0.02"}[0],
+		"IR_LUX_SCALE":                 &[]string{"0"}[0],
+		"COLOR_TEMPERATURE_ENABLED":    &[]string{"false"}[0],
+		"DOMINANT_COLOR_ENABLED":       &[]string{"false"}[0],
+		"FROZEN_DETECTION_ENABLED":     &[]string{"false"}[0],
+		"SHARPNESS_ENABLED":            &[]string{"false"}[0],
+		"NOISE_ENABLED":                &[]string{"false"}[0],
+		"BLANK_FRAME_THRESHOLD":        &[]string{"0"}[0],
+		"DARK_PIXELS_ENABLED":          &[]string{"false"}[0],
+		"DARK_PIXEL_THRESHOLD":         &[]string{"40"}[0],
+		"MOTION_ENABLED":               &[]string{"false"}[0],
+		"MOTION_PIXEL_THRESHOLD":       &[]string{"25"}[0],
+		"MOTION_RATIO_THRESHOLD":       &[]string{"0.02"}[0],
+		"FROZEN_HASH_DISTANCE":         &[]string{"0"}[0],
+		"FROZEN_FRAME_CYCLES":          &[]string{"10"}[0],
+		"EVENTS_ENABLED":               &[]string{"false"}[0],
+		"EVENT_CHANGE_PERCENT":         &[]string{"50"}[0],
+		"EVENT_MIN_CHANGE":             &[]string{"10"}[0],
+		"HISTOGRAM_ENABLED":            &[]string{"false"}[0],
+		"HISTOGRAM_BUCKETS":            &[]string{"16"}[0],
+		"LUMINANCE_STATS_ENABLED":      &[]string{"false"}[0],
+		"OUTPUTS":                      &[]string{OutputLux}[0],
+		"SMOOTHING":                    &[]string{SmoothingNone}[0],
+		"SMOOTHING_ALPHA":              &[]string{"0.3"}[0],
+		"SMOOTHING_WINDOW":             &[]string{"5"}[0],
+		"KALMAN_PROCESS_NOISE":         &[]string{"0.001"}[0],
+		"KALMAN_MEASUREMENT_NOISE":     &[]string{"0.05"}[0],
+		"SMOOTHING_RAW_ATTRIBUTE":      &[]string{"false"}[0],
+		"MAX_STEP":                     &[]string{"0"}[0],
+		"DEAD_BAND":                    &[]string{"0"}[0],
+		"DEAD_BAND_PERCENT":            &[]string{"0"}[0],
+		"DARK_ENABLED":                 &[]string{"false"}[0],
+		"DARK_THRESHOLD_ON":            &[]string{"10"}[0],
+		"DARK_THRESHOLD_OFF":           &[]string{"20"}[0],
+		"DARK_MIN_DWELL":               &[]string{"60"}[0],
+		"DARK_DEVICE_CLASS":            &[]string{""}[0],
+		"THRESHOLD_ENTITY_ENABLED":     &[]string{"false"}[0],
+		"CLASSIFICATION_ENABLED":       &[]string{"false"}[0],
+		"CLASSIFICATION_BANDS":         &[]string{"night:10,dusk:100,golden_hour:1000,day"}[0],
+		"TREND_ENABLED":                &[]string{"false"}[0],
+		"TREND_WINDOW":                 &[]string{"600"}[0],
+		"AGGREGATE_ENABLED":            &[]string{"false"}[0],
+		"AGGREGATE_WINDOW":             &[]string{"900"}[0],
+		"SOLAR_CHECK_ENABLED":          &[]string{"false"}[0],
+		"LATITUDE":                     &[]string{""}[0],
+		"LONGITUDE":                    &[]string{""}[0],
+		"SOLAR_LUX_MARGIN":             &[]string{"500"}[0],
+		"SOLAR_CLAMP_ENABLED":          &[]string{"false"}[0],
+		"STATE_FILE":                   &[]string{""}[0],
+		"CALIBRATION_ENTITIES_ENABLED": &[]string{"false"}[0],
+		"MQTT_HOST":                    &[]string{""}[0],
+		"MQTT_MDNS_ENABLED":            &[]string{"false"}[0],
+		"MQTT_TOPIC":                   &[]string{"darkdetector"}[0],
+		"MQTT_CLIENT_ID":               &[]string{"darkdetector"}[0],
+		"MQTT_CLIENT_ID_SUFFIX":        &[]string{ClientIDSuffixNone}[0],
+		"MQTT_USERNAME":                &[]string{""}[0],
+		"MQTT_PASSWORD":                &[]string{""}[0],
+		"MQTT_FAILBACK_INTERVAL":       &[]string{"60"}[0],
+		"MQTT_BUFFER_SIZE":             &[]string{"0"}[0],
+		"MQTT_CLEAN_SESSION":           &[]string{"true"}[0],
+		"MQTT_KEEPALIVE":               &[]string{"30"}[0],
+		"MQTT_CONNECT_TIMEOUT":         &[]string{"10"}[0],
+		"MQTT_PUBLISH_TIMEOUT":         &[]string{"10"}[0],
+		"MQTT_PUBLISH_RETRIES":         &[]string{"3"}[0],
+		"MQTT_MAX_RECONNECT_INTERVAL":  &[]string{"120"}[0],
+		"MQTT_CONNECT_RETRY_INTERVAL":  &[]string{"30"}[0],
+		"MQTT_PROTOCOL_VERSION":        &[]string{""}[0],
+		"MQTT_SESSION_EXPIRY":          &[]string{"0"}[0],
+		"MQTT_MESSAGE_EXPIRY":          &[]string{"0"}[0],
+		"MQTT_TLS_ENABLED":             &[]string{"false"}[0],
+		"MQTT_CA_FILE":                 &[]string{""}[0],
+		"MQTT_CLIENT_CERT_FILE":        &[]string{""}[0],
+		"MQTT_CLIENT_KEY_FILE":         &[]string{""}[0],
+		"MQTT_TLS_INSECURE":            &[]string{"false"}[0],
+		"MQTT_STATE_QOS":               &[]string{"1"}[0],
+		"MQTT_STATE_RETAIN":            &[]string{"false"}[0],
+		"MQTT_STATE_RESTORE_ENABLED":   &[]string{"false"}[0],
+		"MQTT_STATE_JSON_ENABLED":      &[]string{"false"}[0],
+		"DIAGNOSTICS_ENABLED":          &[]string{"false"}[0],
+		"DIAGNOSTICS_INTERVAL":         &[]string{"0"}[0],
+		"DIAGNOSTIC_ENTITIES_ENABLED":  &[]string{"false"}[0],
+		"LAST_ERROR_ENABLED":           &[]string{"false"}[0],
+		"MQTT_AVAILABILITY_QOS":        &[]string{"2"}[0],
+		"MQTT_AVAILABILITY_RETAIN":     &[]string{"true"}[0],
+		"MQTT_DISCOVERY_QOS":           &[]string{"1"}[0],
+		"MQTT_DISCOVERY_RETAIN":        &[]string{"true"}[0],
+		"HASS_AUTO_DISCOVERY_ENABLED":  &[]string{"true"}[0],
+		"HASS_AUTO_DISCOVERY_TOPIC":    &[]string{"homeassistant"}[0],
+		"HASS_DISCOVERY_TOPIC":         &[]string{"{prefix}/{component}/{object_id}/config"}[0],
+		"HASS_DISCOVERY_FORMAT":        &[]string{DiscoveryFormatEntity}[0],
+		"HASS_ICONS":                   &[]string{""}[0],
+		"HASS_DEVICE_CLASSES":          &[]string{""}[0],
+		"HASS_FORCE_UPDATE":            &[]string{"false"}[0],
+		"MQTT_BASE_TOPIC":              &[]string{"{topic}/{unique_id}"}[0],
+		"MQTT_STATE_TOPIC":             &[]string{"{base}/state"}[0],
+		"MQTT_AVAILABILITY_TOPIC":      &[]string{"{base}/availability"}[0],
+		"MQTT_STATUS_TOPIC":            &[]string{""}[0],
+		"MQTT_CAMERA_TOPIC":            &[]string{""}[0],
+		"MQTT_PAYLOAD_AVAILABLE":       &[]string{"online"}[0],
+		"MQTT_PAYLOAD_NOT_AVAILABLE":   &[]string{"offline"}[0],
+		"HASS_NAME":                    &[]string{"Light Sensor"}[0],
+		"HASS_DEVICE_NAME":             &[]string{"Dark Detector"}[0],
+		"HASS_SUGGESTED_AREA":          &[]string{""}[0],
+		"HASS_CONFIGURATION_URL":       &[]string{""}[0],
+		"HASS_VIA_DEVICE":              &[]string{""}[0],
 	}
 
 	if err := validateEnvVars(envVars); err != nil {
 		return nil, err
 	}
 
-	interval, err := strconv.Atoi(*envVars["INTERVAL"])
+	if (*envVars["IMAGE_URL"] == "") == (*envVars["IMAGE_TOPIC"] == "") {
+		return nil, fmt.Errorf("either IMAGE_URL or IMAGE_TOPIC must be set")
+	}
+
+	interval, err := parseInt(envVars, "INTERVAL")
 	if err != nil {
-		return nil, fmt.Errorf("error parsing INTERVAL: %v", err)
+		return nil, err
+	}
+	if interval < 1 {
+		return nil, fmt.Errorf("INTERVAL must be at least 1, got %d", interval)
 	}
 
-	mqttHost := buildMQTTHost(*envVars["MQTT_HOST"])
+	expireAfterCycles, err := parseInt(envVars, "EXPIRE_AFTER_CYCLES")
+	if err != nil {
+		return nil, err
+	}
+	if expireAfterCycles < 0 || expireAfterCycles == 1 {
+		// A single interval would expire readings that are merely a little late
+		return nil, fmt.Errorf("EXPIRE_AFTER_CYCLES must be 0 or at least 2, got %d", expireAfterCycles)
+	}
+
+	mqttProtocolVersion, err := parseMQTTProtocolVersion(*envVars["MQTT_PROTOCOL_VERSION"])
+	if err != nil {
+		return nil, err
+	}
+	mqttExpiry := make(map[string]int)
+	for _, key := range []string{"MQTT_SESSION_EXPIRY", "MQTT_MESSAGE_EXPIRY"} {
+		if mqttExpiry[key], err = parseInt(envVars, key); err != nil {
+			return nil, err
+		}
+		if mqttExpiry[key] < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %d", key, mqttExpiry[key])
+		}
+		if mqttExpiry[key] > 0 && mqttProtocolVersion != 5 {
+			// Expiry intervals are properties that only MQTT 5 has
+			return nil, fmt.Errorf("%s needs MQTT_PROTOCOL_VERSION 5", key)
+		}
+	}
+
+	mqttTLSEnabled := parseBool(envVars, "MQTT_TLS_ENABLED")
+	var mqttHosts []string
+	if *envVars["MQTT_HOST"] != "" || !parseBool(envVars, "MQTT_MDNS_ENABLED") {
+		// Otherwise the publisher looks for a broker when it starts
+		if mqttHosts, err = buildMQTTHosts(*envVars["MQTT_HOST"], mqttTLSEnabled); err != nil {
+			return nil, err
+		}
+	}
+	mqttFailbackInterval, err := parseInt(envVars, "MQTT_FAILBACK_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if mqttFailbackInterval < 0 {
+		return nil, fmt.Errorf("MQTT_FAILBACK_INTERVAL must not be negative, got %d", mqttFailbackInterval)
+	}
+	mqttBufferSize, err := parseInt(envVars, "MQTT_BUFFER_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	if mqttBufferSize < 0 {
+		return nil, fmt.Errorf("MQTT_BUFFER_SIZE must not be negative, got %d", mqttBufferSize)
+	}
+	mqttTimeouts := make(map[string]int)
+	for _, key := range []string{"MQTT_KEEPALIVE", "MQTT_CONNECT_TIMEOUT", "MQTT_PUBLISH_TIMEOUT", "MQTT_MAX_RECONNECT_INTERVAL", "MQTT_CONNECT_RETRY_INTERVAL"} {
+		if mqttTimeouts[key], err = parseInt(envVars, key); err != nil {
+			return nil, err
+		}
+		if mqttTimeouts[key] < 1 {
+			return nil, fmt.Errorf("%s must be at least 1, got %d", key, mqttTimeouts[key])
+		}
+	}
+
+	mqttPublishRetries, err := parseInt(envVars, "MQTT_PUBLISH_RETRIES")
+	if err != nil {
+		return nil, err
+	}
+	if mqttPublishRetries < 0 {
+		return nil, fmt.Errorf("MQTT_PUBLISH_RETRIES must not be negative, got %d", mqttPublishRetries)
+	}
+
+	mqttCleanSession := parseBool(envVars, "MQTT_CLEAN_SESSION")
+	mqttClientIDSuffix := strings.ToLower(*envVars["MQTT_CLIENT_ID_SUFFIX"])
+	switch mqttClientIDSuffix {
+	case ClientIDSuffixNone, ClientIDSuffixHostname:
+	case ClientIDSuffixRandom:
+		if !mqttCleanSession {
+			// The broker couldn't find the session again after a restart
+			return nil, fmt.Errorf("MQTT_CLIENT_ID_SUFFIX %q needs MQTT_CLEAN_SESSION", ClientIDSuffixRandom)
+		}
+	default:
+		return nil, fmt.Errorf("MQTT_CLIENT_ID_SUFFIX must be %s, %s or %s, got %q", ClientIDSuffixNone, ClientIDSuffixHostname, ClientIDSuffixRandom, mqttClientIDSuffix)
+	}
+	hassDiscoveryFormat := strings.ToLower(*envVars["HASS_DISCOVERY_FORMAT"])
+	if hassDiscoveryFormat != DiscoveryFormatEntity && hassDiscoveryFormat != DiscoveryFormatDevice {
+		return nil, fmt.Errorf("HASS_DISCOVERY_FORMAT must be %s or %s, got %q", DiscoveryFormatEntity, DiscoveryFormatDevice, hassDiscoveryFormat)
+	}
+	hassIcons, err := getEntityOverrides(envVars, "HASS_ICONS")
+	if err != nil {
+		return nil, err
+	}
+	hassDeviceClasses, err := getEntityOverrides(envVars, "HASS_DEVICE_CLASSES")
+	if err != nil {
+		return nil, err
+	}
+	if *envVars["MQTT_PASSWORD"] != "" && *envVars["MQTT_USERNAME"] == "" && mqttProtocolVersion != 5 {
+		// MQTT 3.1.1 doesn't allow a password without a username, MQTT 5 does
+		return nil, fmt.Errorf("MQTT_PASSWORD without MQTT_USERNAME needs MQTT_PROTOCOL_VERSION 5, or set any username for brokers that only check the password")
+	}
+	if (*envVars["MQTT_CLIENT_CERT_FILE"] == "") != (*envVars["MQTT_CLIENT_KEY_FILE"] == "") {
+		return nil, fmt.Errorf("MQTT_CLIENT_CERT_FILE and MQTT_CLIENT_KEY_FILE must be set together")
+	}
+
+	diagnosticsInterval, err := parseInt(envVars, "DIAGNOSTICS_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if diagnosticsInterval < 0 {
+		return nil, fmt.Errorf("DIAGNOSTICS_INTERVAL must not be negative, got %d", diagnosticsInterval)
+	}
+
+	topicTemplates := make(map[string]string)
+	for key, placeholders := range topicPlaceholders {
+		if topicTemplates[key], err = parseTopicTemplate(envVars, key, placeholders); err != nil {
+			return nil, err
+		}
+	}
+	if topicTemplates["MQTT_CAMERA_TOPIC"] != "" && *envVars["IMAGE_URL"] == "" {
+		return nil, fmt.Errorf("MQTT_CAMERA_TOPIC needs IMAGE_URL, images arriving on IMAGE_TOPIC tell nothing about the camera being down")
+	}
+
+	if *envVars["MQTT_PAYLOAD_AVAILABLE"] == *envVars["MQTT_PAYLOAD_NOT_AVAILABLE"] {
+		return nil, fmt.Errorf("MQTT_PAYLOAD_AVAILABLE and MQTT_PAYLOAD_NOT_AVAILABLE must differ")
+	}
+
+	mqttStateRetain := parseBool(envVars, "MQTT_STATE_RETAIN")
+	mqttStateRestoreEnabled := parseBool(envVars, "MQTT_STATE_RESTORE_ENABLED")
+	if mqttStateRestoreEnabled && !mqttStateRetain {
+		return nil, fmt.Errorf("MQTT_STATE_RESTORE_ENABLED needs MQTT_STATE_RETAIN, the broker keeps no state to restore otherwise")
+	}
+
+	mqttStateQoS, err := parseQoS(envVars, "MQTT_STATE_QOS")
+	if err != nil {
+		return nil, err
+	}
+	mqttAvailabilityQoS, err := parseQoS(envVars, "MQTT_AVAILABILITY_QOS")
+	if err != nil {
+		return nil, err
+	}
+	mqttDiscoveryQoS, err := parseQoS(envVars, "MQTT_DISCOVERY_QOS")
+	if err != nil {
+		return nil, err
+	}
 
 	imageCrop, err := getImageCrop()
 	if err != nil {
 		return nil, fmt.Errorf("error parsing IMAGE_CROP: %v", err)
 	}
 
+	cropPresets, err := getCropPresets()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CROP_PRESETS: %v", err)
+	}
+
+	var imageExclude Crops
+	if value := os.Getenv("IMAGE_EXCLUDE"); value != "" {
+		if imageExclude, err = ParseCrops(value); err != nil {
+			return nil, fmt.Errorf("error parsing IMAGE_EXCLUDE: %v", err)
+		}
+	}
+
+	downscale, err := parseInt(envVars, "DOWNSCALE")
+	if err != nil {
+		return nil, err
+	}
+	if downscale < 1 {
+		return nil, fmt.Errorf("DOWNSCALE must be at least 1, got %d", downscale)
+	}
+
+	imageRotation, err := parseInt(envVars, "IMAGE_ROTATION")
+	if err != nil {
+		return nil, err
+	}
+	if imageRotation != 0 && imageRotation != 90 && imageRotation != 180 && imageRotation != 270 {
+		return nil, fmt.Errorf("IMAGE_ROTATION must be 0, 90, 180 or 270, got %d", imageRotation)
+	}
+
+	regions, err := getRegions()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing REGIONS: %v", err)
+	}
+
+	trimPercent, err := parseFloat(envVars, "LUX_TRIM_PERCENT")
+	if err != nil {
+		return nil, err
+	}
+	if trimPercent < 0 || trimPercent >= 50 {
+		return nil, fmt.Errorf("LUX_TRIM_PERCENT must be between 0 and 50, got %v", trimPercent)
+	}
+
+	clipThreshold, err := parseFloat(envVars, "LUX_CLIP_THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+	if clipThreshold < 0 || clipThreshold > 1 {
+		return nil, fmt.Errorf("LUX_CLIP_THRESHOLD must be between 0 and 1, got %v", clipThreshold)
+	}
+
+	luxScale, err := parseFloat(envVars, "LUX_SCALE")
+	if err != nil {
+		return nil, err
+	}
+	if luxScale <= 0 {
+		return nil, fmt.Errorf("LUX_SCALE must be positive, got %v", luxScale)
+	}
+
+	calibrationCurve := strings.ToLower(*envVars["CALIBRATION_CURVE"])
+	calibrationTable, err := getCalibrationTable(*envVars["CALIBRATION_TABLE"])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CALIBRATION_TABLE: %v", err)
+	}
+	if calibrationCurve == CurveTable && len(calibrationTable) < 2 {
+		return nil, fmt.Errorf("CALIBRATION_TABLE needs at least two points when CALIBRATION_CURVE is %q", CurveTable)
+	}
+	calibrationCoefficients, err := getFloats(*envVars["CALIBRATION_COEFFICIENTS"])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CALIBRATION_COEFFICIENTS: %v", err)
+	}
+	if (calibrationCurve == CurvePower || calibrationCurve == CurveLog) && len(calibrationCoefficients) != 2 {
+		return nil, fmt.Errorf("CALIBRATION_COEFFICIENTS must be two numbers a,b when CALIBRATION_CURVE is %q", calibrationCurve)
+	}
+
+	calibrationSchedule, err := getSchedule(*envVars["CALIBRATION_SCHEDULE"])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CALIBRATION_SCHEDULE: %v", err)
+	}
+
+	referenceMinSamples, err := parseInt(envVars, "REFERENCE_MIN_SAMPLES")
+	if err != nil {
+		return nil, err
+	}
+	if referenceMinSamples < 1 {
+		return nil, fmt.Errorf("REFERENCE_MIN_SAMPLES must be at least 1, got %d", referenceMinSamples)
+	}
+
+	transferGamma, err := parseFloat(envVars, "TRANSFER_GAMMA")
+	if err != nil {
+		return nil, err
+	}
+	if transferGamma <= 0 {
+		return nil, fmt.Errorf("TRANSFER_GAMMA must be positive, got %v", transferGamma)
+	}
+
+	meteringSpotSize, err := parseFloat(envVars, "METERING_SPOT_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	if meteringSpotSize <= 0 || meteringSpotSize > 100 {
+		return nil, fmt.Errorf("METERING_SPOT_SIZE must be greater than 0 and at most 100, got %v", meteringSpotSize)
+	}
+
+	irChromaThreshold, err := parseFloat(envVars, "IR_CHROMA_THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+	if irChromaThreshold < 0 || irChromaThreshold > 1 {
+		return nil, fmt.Errorf("IR_CHROMA_THRESHOLD must be between 0 and 1, got %v", irChromaThreshold)
+	}
+
+	irLuxScale, err := parseFloat(envVars, "IR_LUX_SCALE")
+	if err != nil {
+		return nil, err
+	}
+	if irLuxScale < 0 {
+		return nil, fmt.Errorf("IR_LUX_SCALE must not be negative, got %v", irLuxScale)
+	}
+
+	frozenHashDistance, err := parseInt(envVars, "FROZEN_HASH_DISTANCE")
+	if err != nil {
+		return nil, err
+	}
+	if frozenHashDistance < 0 || frozenHashDistance > 64 {
+		return nil, fmt.Errorf("FROZEN_HASH_DISTANCE must be between 0 and 64, got %d", frozenHashDistance)
+	}
+	frozenFrameCycles, err := parseInt(envVars, "FROZEN_FRAME_CYCLES")
+	if err != nil {
+		return nil, err
+	}
+	if frozenFrameCycles < 1 {
+		return nil, fmt.Errorf("FROZEN_FRAME_CYCLES must be at least 1, got %d", frozenFrameCycles)
+	}
+
+	eventChangePercent, err := parseFloat(envVars, "EVENT_CHANGE_PERCENT")
+	if err != nil {
+		return nil, err
+	}
+	if eventChangePercent <= 0 {
+		return nil, fmt.Errorf("EVENT_CHANGE_PERCENT must be positive, got %v", eventChangePercent)
+	}
+	eventMinChange, err := parseFloat(envVars, "EVENT_MIN_CHANGE")
+	if err != nil {
+		return nil, err
+	}
+	if eventMinChange < 0 {
+		return nil, fmt.Errorf("EVENT_MIN_CHANGE must not be negative, got %v", eventMinChange)
+	}
+
+	blankFrameThreshold, err := parseFloat(envVars, "BLANK_FRAME_THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+	if blankFrameThreshold < 0 {
+		return nil, fmt.Errorf("BLANK_FRAME_THRESHOLD must not be negative, got %v", blankFrameThreshold)
+	}
+
+	darkPixelThreshold, err := parseFloat(envVars, "DARK_PIXEL_THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+	if darkPixelThreshold < 0 || darkPixelThreshold > 255 {
+		return nil, fmt.Errorf("DARK_PIXEL_THRESHOLD must be between 0 and 255, got %v", darkPixelThreshold)
+	}
+
+	motionPixelThreshold, err := parseFloat(envVars, "MOTION_PIXEL_THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+	if motionPixelThreshold < 0 || motionPixelThreshold > 255 {
+		return nil, fmt.Errorf("MOTION_PIXEL_THRESHOLD must be between 0 and 255, got %v", motionPixelThreshold)
+	}
+	motionRatioThreshold, err := parseFloat(envVars, "MOTION_RATIO_THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+	if motionRatioThreshold < 0 || motionRatioThreshold > 1 {
+		return nil, fmt.Errorf("MOTION_RATIO_THRESHOLD must be between 0 and 1, got %v", motionRatioThreshold)
+	}
+
+	histogramBuckets, err := parseInt(envVars, "HISTOGRAM_BUCKETS")
+	if err != nil {
+		return nil, err
+	}
+	if histogramBuckets < 1 || histogramBuckets > 256 {
+		return nil, fmt.Errorf("HISTOGRAM_BUCKETS must be between 1 and 256, got %d", histogramBuckets)
+	}
+
+	cameraEntityQuality, err := parseInt(envVars, "CAMERA_ENTITY_QUALITY")
+	if err != nil {
+		return nil, err
+	}
+	if cameraEntityQuality < 1 || cameraEntityQuality > 100 {
+		return nil, fmt.Errorf("CAMERA_ENTITY_QUALITY must be between 1 and 100, got %d", cameraEntityQuality)
+	}
+	cameraEntityInterval, err := parseInt(envVars, "CAMERA_ENTITY_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if cameraEntityInterval < 0 {
+		return nil, fmt.Errorf("CAMERA_ENTITY_INTERVAL must not be negative, got %d", cameraEntityInterval)
+	}
+	annotatedEntityInterval, err := parseInt(envVars, "ANNOTATED_ENTITY_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if annotatedEntityInterval < 0 {
+		return nil, fmt.Errorf("ANNOTATED_ENTITY_INTERVAL must not be negative, got %d", annotatedEntityInterval)
+	}
+
+	outputs, err := getOutputs(*envVars["OUTPUTS"])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing OUTPUTS: %v", err)
+	}
+
+	smoothingAlpha, err := parseFloat(envVars, "SMOOTHING_ALPHA")
+	if err != nil {
+		return nil, err
+	}
+	if smoothingAlpha <= 0 || smoothingAlpha > 1 {
+		return nil, fmt.Errorf("SMOOTHING_ALPHA must be greater than 0 and at most 1, got %v", smoothingAlpha)
+	}
+
+	smoothingWindow, err := parseInt(envVars, "SMOOTHING_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if smoothingWindow < 1 {
+		return nil, fmt.Errorf("SMOOTHING_WINDOW must be at least 1, got %d", smoothingWindow)
+	}
+
+	kalmanProcessNoise, err := parseFloat(envVars, "KALMAN_PROCESS_NOISE")
+	if err != nil {
+		return nil, err
+	}
+	kalmanMeasurementNoise, err := parseFloat(envVars, "KALMAN_MEASUREMENT_NOISE")
+	if err != nil {
+		return nil, err
+	}
+	if kalmanProcessNoise <= 0 || kalmanMeasurementNoise <= 0 {
+		return nil, fmt.Errorf("KALMAN_PROCESS_NOISE and KALMAN_MEASUREMENT_NOISE must be positive")
+	}
+
+	maxStep, err := parseFloat(envVars, "MAX_STEP")
+	if err != nil {
+		return nil, err
+	}
+	if maxStep < 0 {
+		return nil, fmt.Errorf("MAX_STEP must not be negative, got %v", maxStep)
+	}
+
+	deadBand, err := parseFloat(envVars, "DEAD_BAND")
+	if err != nil {
+		return nil, err
+	}
+	if deadBand < 0 {
+		return nil, fmt.Errorf("DEAD_BAND must not be negative, got %v", deadBand)
+	}
+	deadBandPercent, err := parseFloat(envVars, "DEAD_BAND_PERCENT")
+	if err != nil {
+		return nil, err
+	}
+	if deadBandPercent < 0 {
+		return nil, fmt.Errorf("DEAD_BAND_PERCENT must not be negative, got %v", deadBandPercent)
+	}
+
+	darkThresholdOn, err := parseFloat(envVars, "DARK_THRESHOLD_ON")
+	if err != nil {
+		return nil, err
+	}
+	darkThresholdOff, err := parseFloat(envVars, "DARK_THRESHOLD_OFF")
+	if err != nil {
+		return nil, err
+	}
+	if darkThresholdOff < darkThresholdOn {
+		return nil, fmt.Errorf("DARK_THRESHOLD_OFF (%v) must not be below DARK_THRESHOLD_ON (%v)", darkThresholdOff, darkThresholdOn)
+	}
+	darkEnabled := parseBool(envVars, "DARK_ENABLED")
+	thresholdEntityEnabled := parseBool(envVars, "THRESHOLD_ENTITY_ENABLED")
+	if thresholdEntityEnabled && !darkEnabled {
+		return nil, fmt.Errorf("THRESHOLD_ENTITY_ENABLED needs DARK_ENABLED, there is no threshold to change otherwise")
+	}
+	darkMinDwell, err := parseInt(envVars, "DARK_MIN_DWELL")
+	if err != nil {
+		return nil, err
+	}
+	if darkMinDwell < 0 {
+		return nil, fmt.Errorf("DARK_MIN_DWELL must not be negative, got %d", darkMinDwell)
+	}
+
+	classificationBands, err := getBands(*envVars["CLASSIFICATION_BANDS"])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CLASSIFICATION_BANDS: %v", err)
+	}
+
+	trendWindow, err := parseInt(envVars, "TREND_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if trendWindow <= 0 {
+		return nil, fmt.Errorf("TREND_WINDOW must be positive, got %d", trendWindow)
+	}
+
+	aggregateWindow, err := parseInt(envVars, "AGGREGATE_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if aggregateWindow <= 0 {
+		return nil, fmt.Errorf("AGGREGATE_WINDOW must be positive, got %d", aggregateWindow)
+	}
+
+	solarCheckEnabled := parseBool(envVars, "SOLAR_CHECK_ENABLED")
+	var latitude, longitude float64
+	if solarCheckEnabled {
+		if latitude, err = parseFloat(envVars, "LATITUDE"); err != nil {
+			return nil, err
+		}
+		if latitude < -90 || latitude > 90 {
+			return nil, fmt.Errorf("LATITUDE must be between -90 and 90, got %v", latitude)
+		}
+		if longitude, err = parseFloat(envVars, "LONGITUDE"); err != nil {
+			return nil, err
+		}
+		if longitude < -180 || longitude > 180 {
+			return nil, fmt.Errorf("LONGITUDE must be between -180 and 180, got %v", longitude)
+		}
+	}
+	solarLuxMargin, err := parseFloat(envVars, "SOLAR_LUX_MARGIN")
+	if err != nil {
+		return nil, err
+	}
+	if solarLuxMargin < 0 {
+		return nil, fmt.Errorf("SOLAR_LUX_MARGIN must not be negative, got %v", solarLuxMargin)
+	}
+
 	config := &Config{
-		ImageURL:                 *envVars["IMAGE_URL"],
-		ImageCrop:                imageCrop,
-		Interval:                 interval,
-		MQTTHost:                 mqttHost,
-		MQTTTopic:                *envVars["MQTT_TOPIC"],
-		MQTTClientID:             *envVars["MQTT_CLIENT_ID"],
-		MQTTUsername:             os.Getenv("MQTT_USERNAME"),
-		MQTTPassword:             os.Getenv("MQTT_PASSWORD"),
-		HASSAutoDiscoveryEnabled: strings.EqualFold(*envVars["HASS_AUTO_DISCOVERY_ENABLED"], "true"),
-		HASSAutoDiscoveryTopic:   *envVars["HASS_AUTO_DISCOVERY_TOPIC"],
-		HASSName:                 *envVars["HASS_NAME"],
+		ImageURL:                   *envVars["IMAGE_URL"],
+		ImageTopic:                 *envVars["IMAGE_TOPIC"],
+		ImageUsername:              *envVars["IMAGE_USERNAME"],
+		ImagePassword:              *envVars["IMAGE_PASSWORD"],
+		ImageCrop:                  imageCrop,
+		CropPresets:                cropPresets,
+		ImageMask:                  *envVars["IMAGE_MASK"],
+		ImageExclude:               imageExclude,
+		WebUIAddress:               *envVars["WEB_UI_ADDRESS"],
+		PreviewFile:                *envVars["PREVIEW_FILE"],
+		ImageEntityEnabled:         parseBool(envVars, "IMAGE_ENTITY_ENABLED"),
+		CameraEntityEnabled:        parseBool(envVars, "CAMERA_ENTITY_ENABLED"),
+		CameraEntityQuality:        cameraEntityQuality,
+		CameraEntityInterval:       cameraEntityInterval,
+		AnnotatedEntityEnabled:     parseBool(envVars, "ANNOTATED_ENTITY_ENABLED"),
+		AnnotatedEntityInterval:    annotatedEntityInterval,
+		SwitchEntityEnabled:        parseBool(envVars, "SWITCH_ENTITY_ENABLED"),
+		ButtonEntityEnabled:        parseBool(envVars, "BUTTON_ENTITY_ENABLED"),
+		Downscale:                  downscale,
+		ImageRotation:              imageRotation,
+		ImageFlip:                  strings.ToLower(*envVars["IMAGE_FLIP"]),
+		EXIFOrientationEnabled:     parseBool(envVars, "EXIF_ORIENTATION_ENABLED"),
+		Regions:                    regions,
+		LuxTrimPercent:             trimPercent,
+		LuxClipThreshold:           clipThreshold,
+		LuxScale:                   luxScale,
+		CalibrationCurve:           calibrationCurve,
+		CalibrationTable:           calibrationTable,
+		CalibrationCoefficients:    calibrationCoefficients,
+		CalibrationFile:            *envVars["CALIBRATION_FILE"],
+		CalibrationSchedule:        calibrationSchedule,
+		ReferenceTopic:             *envVars["REFERENCE_TOPIC"],
+		ReferenceKey:               *envVars["REFERENCE_KEY"],
+		ReferenceMinSamples:        referenceMinSamples,
+		TransferFunction:           strings.ToLower(*envVars["TRANSFER_FUNCTION"]),
+		TransferGamma:              transferGamma,
+		LumaCoefficients:           strings.ToLower(*envVars["LUMA_COEFFICIENTS"]),
+		MeteringMode:               strings.ToLower(*envVars["METERING_MODE"]),
+		MeteringSpotSize:           meteringSpotSize,
+		EXIFExposureEnabled:        parseBool(envVars, "EXIF_EXPOSURE_ENABLED"),
+		IRModeEnabled:              parseBool(envVars, "IR_MODE_ENABLED"),
+		IRChromaThreshold:          irChromaThreshold,
+		IRLuxScale:                 irLuxScale,
+		ColorTemperatureEnabled:    parseBool(envVars, "COLOR_TEMPERATURE_ENABLED"),
+		DominantColorEnabled:       parseBool(envVars, "DOMINANT_COLOR_ENABLED"),
+		FrozenDetectionEnabled:     parseBool(envVars, "FROZEN_DETECTION_ENABLED"),
+		SharpnessEnabled:           parseBool(envVars, "SHARPNESS_ENABLED"),
+		NoiseEnabled:               parseBool(envVars, "NOISE_ENABLED"),
+		BlankFrameThreshold:        blankFrameThreshold,
+		DarkPixelsEnabled:          parseBool(envVars, "DARK_PIXELS_ENABLED"),
+		DarkPixelThreshold:         darkPixelThreshold,
+		MotionEnabled:              parseBool(envVars, "MOTION_ENABLED"),
+		MotionPixelThreshold:       motionPixelThreshold,
+		MotionRatioThreshold:       motionRatioThreshold,
+		FrozenHashDistance:         frozenHashDistance,
+		FrozenFrameCycles:          frozenFrameCycles,
+		EventsEnabled:              parseBool(envVars, "EVENTS_ENABLED"),
+		EventChangePercent:         eventChangePercent,
+		EventMinChange:             eventMinChange,
+		HistogramEnabled:           parseBool(envVars, "HISTOGRAM_ENABLED"),
+		HistogramBuckets:           histogramBuckets,
+		LuminanceStatsEnabled:      parseBool(envVars, "LUMINANCE_STATS_ENABLED"),
+		Outputs:                    outputs,
+		Smoothing:                  strings.ToLower(*envVars["SMOOTHING"]),
+		SmoothingAlpha:             smoothingAlpha,
+		SmoothingWindow:            smoothingWindow,
+		KalmanProcessNoise:         kalmanProcessNoise,
+		KalmanMeasurementNoise:     kalmanMeasurementNoise,
+		SmoothingRawAttribute:      parseBool(envVars, "SMOOTHING_RAW_ATTRIBUTE"),
+		MaxStep:                    maxStep,
+		DeadBand:                   deadBand,
+		DeadBandPercent:            deadBandPercent,
+		DarkEnabled:                darkEnabled,
+		DarkThresholdOn:            darkThresholdOn,
+		DarkThresholdOff:           darkThresholdOff,
+		DarkMinDwell:               darkMinDwell,
+		DarkDeviceClass:            strings.ToLower(*envVars["DARK_DEVICE_CLASS"]),
+		ThresholdEntityEnabled:     thresholdEntityEnabled,
+		ClassificationEnabled:      parseBool(envVars, "CLASSIFICATION_ENABLED"),
+		ClassificationBands:        classificationBands,
+		TrendEnabled:               parseBool(envVars, "TREND_ENABLED"),
+		TrendWindow:                trendWindow,
+		AggregateEnabled:           parseBool(envVars, "AGGREGATE_ENABLED"),
+		AggregateWindow:            aggregateWindow,
+		SolarCheckEnabled:          solarCheckEnabled,
+		Latitude:                   latitude,
+		Longitude:                  longitude,
+		SolarLuxMargin:             solarLuxMargin,
+		SolarClampEnabled:          parseBool(envVars, "SOLAR_CLAMP_ENABLED"),
+		Interval:                   interval,
+		IntervalEntityEnabled:      parseBool(envVars, "INTERVAL_ENTITY_ENABLED"),
+		ExpireAfterCycles:          expireAfterCycles,
+		StateFile:                  *envVars["STATE_FILE"],
+		CalibrationEntitiesEnabled: parseBool(envVars, "CALIBRATION_ENTITIES_ENABLED"),
+		MQTTHosts:                  mqttHosts,
+		MQTTFailbackInterval:       mqttFailbackInterval,
+		MQTTBufferSize:             mqttBufferSize,
+		MQTTCleanSession:           mqttCleanSession,
+		MQTTKeepAlive:              mqttTimeouts["MQTT_KEEPALIVE"],
+		MQTTConnectTimeout:         mqttTimeouts["MQTT_CONNECT_TIMEOUT"],
+		MQTTPublishTimeout:         mqttTimeouts["MQTT_PUBLISH_TIMEOUT"],
+		MQTTPublishRetries:         mqttPublishRetries,
+		MQTTMaxReconnectInterval:   mqttTimeouts["MQTT_MAX_RECONNECT_INTERVAL"],
+		MQTTConnectRetryInterval:   mqttTimeouts["MQTT_CONNECT_RETRY_INTERVAL"],
+		MQTTTopic:                  *envVars["MQTT_TOPIC"],
+		MQTTClientID:               *envVars["MQTT_CLIENT_ID"],
+		MQTTClientIDSuffix:         mqttClientIDSuffix,
+		MQTTUsername:               *envVars["MQTT_USERNAME"],
+		MQTTPassword:               *envVars["MQTT_PASSWORD"],
+		MQTTProtocolVersion:        mqttProtocolVersion,
+		MQTTSessionExpiry:          mqttExpiry["MQTT_SESSION_EXPIRY"],
+		MQTTMessageExpiry:          mqttExpiry["MQTT_MESSAGE_EXPIRY"],
+		MQTTTLSEnabled:             mqttTLSEnabled,
+		MQTTCAFile:                 *envVars["MQTT_CA_FILE"],
+		MQTTClientCertFile:         *envVars["MQTT_CLIENT_CERT_FILE"],
+		MQTTClientKeyFile:          *envVars["MQTT_CLIENT_KEY_FILE"],
+		MQTTTLSInsecure:            parseBool(envVars, "MQTT_TLS_INSECURE"),
+		MQTTStateQoS:               mqttStateQoS,
+		MQTTStateRetain:            mqttStateRetain,
+		MQTTStateRestoreEnabled:    mqttStateRestoreEnabled,
+		MQTTStateJSONEnabled:       parseBool(envVars, "MQTT_STATE_JSON_ENABLED"),
+		DiagnosticsEnabled:         parseBool(envVars, "DIAGNOSTICS_ENABLED"),
+		DiagnosticsInterval:        diagnosticsInterval,
+		DiagnosticEntitiesEnabled:  parseBool(envVars, "DIAGNOSTIC_ENTITIES_ENABLED"),
+		LastErrorEnabled:           parseBool(envVars, "LAST_ERROR_ENABLED"),
+		MQTTAvailabilityQoS:        mqttAvailabilityQoS,
+		MQTTAvailabilityRetain:     parseBool(envVars, "MQTT_AVAILABILITY_RETAIN"),
+		MQTTDiscoveryQoS:           mqttDiscoveryQoS,
+		MQTTDiscoveryRetain:        parseBool(envVars, "MQTT_DISCOVERY_RETAIN"),
+		HASSAutoDiscoveryEnabled:   parseBool(envVars, "HASS_AUTO_DISCOVERY_ENABLED"),
+		HASSAutoDiscoveryTopic:     *envVars["HASS_AUTO_DISCOVERY_TOPIC"],
+		HASSDiscoveryTopic:         topicTemplates["HASS_DISCOVERY_TOPIC"],
+		HASSDiscoveryFormat:        hassDiscoveryFormat,
+		HASSForceUpdate:            parseBool(envVars, "HASS_FORCE_UPDATE"),
+		HASSIcons:                  hassIcons,
+		HASSDeviceClasses:          hassDeviceClasses,
+		MQTTBaseTopic:              topicTemplates["MQTT_BASE_TOPIC"],
+		MQTTStateTopic:             topicTemplates["MQTT_STATE_TOPIC"],
+		MQTTAvailabilityTopic:      topicTemplates["MQTT_AVAILABILITY_TOPIC"],
+		MQTTStatusTopic:            topicTemplates["MQTT_STATUS_TOPIC"],
+		MQTTCameraTopic:            topicTemplates["MQTT_CAMERA_TOPIC"],
+		MQTTPayloadAvailable:       *envVars["MQTT_PAYLOAD_AVAILABLE"],
+		MQTTPayloadNotAvailable:    *envVars["MQTT_PAYLOAD_NOT_AVAILABLE"],
+		HASSName:                   *envVars["HASS_NAME"],
+		HASSDeviceName:             *envVars["HASS_DEVICE_NAME"],
+		HASSSuggestedArea:          *envVars["HASS_SUGGESTED_AREA"],
+		HASSConfigurationURL:       *envVars["HASS_CONFIGURATION_URL"],
+		HASSViaDevice:              *envVars["HASS_VIA_DEVICE"],
+	}
+
+	if path := *envVars["CALIBRATION_PROFILE"]; path != "" {
+		profile, err := LoadProfile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := profile.Apply(config); err != nil {
+			return nil, fmt.Errorf("error applying CALIBRATION_PROFILE: %v", err)
+		}
 	}
 
 	return config, nil
 }
 
-func getImageCrop() (*[]int, error) {
+func getImageCrop() (Crops, error) {
 	value := os.Getenv("IMAGE_CROP")
 	if value == "" {
 		return nil, nil
 	}
 
+	return ParseCrops(value)
+}
+
+// getEntityOverrides parses a comma-separated list of key:value discovery
+// settings of entities, e.g. "classification:mdi:weather-sunset,lux:mdi:sun".
+// Everything after the first colon is the value, which may be empty.
+func getEntityOverrides(envVars map[string]*string, key string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, v := range strings.Split(*envVars[key], ",") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		entity, value, ok := strings.Cut(strings.TrimSpace(v), ":")
+		if !ok || !isIdentifier(entity) {
+			return nil, fmt.Errorf("%s must be a list of entity:value, got %q", key, v)
+		}
+		overrides[entity] = strings.TrimSpace(value)
+	}
+	return overrides, nil
+}
+
+// getCropPresets parses a "|"-separated list of name:crop presets, where the
+// crop takes the IMAGE_CROP format, e.g. "sky:top:100%,30%|full frame:". An
+// empty crop measures the whole frame.
+func getCropPresets() ([]CropPreset, error) {
+	value := os.Getenv("CROP_PRESETS")
+	if value == "" {
+		return nil, nil
+	}
+
+	presets := make([]CropPreset, 0)
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(value, "|") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		name, crop, ok := strings.Cut(v, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("preset %q must be name:crop", v)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate preset %q", name)
+		}
+		seen[name] = true
+
+		preset := CropPreset{Name: name, Crops: Crops{}}
+		if strings.TrimSpace(crop) != "" {
+			crops, err := ParseCrops(crop)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing crop of preset %q: %v", name, err)
+			}
+			preset.Crops = crops
+		}
+		presets = append(presets, preset)
+	}
+	return presets, nil
+}
+
+// getRegions parses a semicolon-separated list of name:x,y,width,height regions,
+// e.g. "driveway:0,300,400,180;sky:0,0,100%,20%". A weight after the name, as
+// in "sky@70:0,0,100%,20%", makes the region part of the combined lux.
+func getRegions() ([]Region, error) {
+	value := os.Getenv("REGIONS")
+	if value == "" {
+		return nil, nil
+	}
+
+	regions := make([]Region, 0)
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(value, ";") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		name, rect, ok := strings.Cut(strings.TrimSpace(v), ":")
+		if !ok {
+			return nil, fmt.Errorf("region %q has no rectangle", v)
+		}
+		var weight float64
+		if n, w, ok := strings.Cut(name, "@"); ok {
+			var err error
+			if weight, err = strconv.ParseFloat(strings.TrimSpace(w), 64); err != nil || weight <= 0 {
+				return nil, fmt.Errorf("weight of region %q must be a positive number, got %q", n, w)
+			}
+			name = n
+		}
+		if !isIdentifier(name) {
+			return nil, fmt.Errorf("region name %q must only contain lowercase letters, digits and underscores", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate region %q", name)
+		}
+		seen[name] = true
+
+		crop, err := ParseCrop(rect)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing rectangle of region %q: %v", name, err)
+		}
+		if crop.Polygon == nil && (crop.Width.Value <= 0 || crop.Height.Value <= 0) {
+			return nil, fmt.Errorf("region %q must be x,y,width,height with a positive size", name)
+		}
+		regions = append(regions, Region{Name: name, Crop: crop, Weight: weight})
+	}
+	return regions, nil
+}
+
+// isIdentifier reports whether name is usable in MQTT topics and unique IDs.
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// HasOutput reports whether the given output was selected in OUTPUTS.
+func (c *Config) HasOutput(output string) bool {
+	for _, o := range c.Outputs {
+		if o == output {
+			return true
+		}
+	}
+	return false
+}
+
+func getOutputs(value string) ([]string, error) {
+	outputs := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		output := strings.ToLower(strings.TrimSpace(v))
+		switch output {
+		case OutputLux, OutputLightness, OutputEV, OutputLog10, OutputBrightness:
+			outputs = append(outputs, output)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown output %q", output)
+		}
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("at least one output is required")
+	}
+	return outputs, nil
+}
+
+// getBands parses a list of name:upper bands ordered from darkest to brightest,
+// e.g. "night:10,dusk:100,day". The last band takes no upper bound.
+func getBands(value string) ([]Band, error) {
 	values := strings.Split(value, ",")
-	crop := make([]int, 0)
-	for _, v := range values {
-		intVal, err := strconv.Atoi(strings.TrimSpace(v))
+	if len(values) < 2 {
+		return nil, fmt.Errorf("at least two bands are required")
+	}
+
+	bands := make([]Band, 0, len(values))
+	for i, v := range values {
+		name, upper, hasUpper := strings.Cut(strings.TrimSpace(v), ":")
+		if name == "" {
+			return nil, fmt.Errorf("band %d has no name", i+1)
+		}
+		band := Band{Name: name, Upper: math.Inf(1)}
+		if i < len(values)-1 {
+			if !hasUpper {
+				return nil, fmt.Errorf("band %q has no upper bound", name)
+			}
+			bound, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing upper bound of band %q: %v", name, err)
+			}
+			if i > 0 && bound <= bands[i-1].Upper {
+				return nil, fmt.Errorf("band %q must have a higher bound than %q", name, bands[i-1].Name)
+			}
+			band.Upper = bound
+		} else if hasUpper {
+			return nil, fmt.Errorf("last band %q must not have an upper bound", name)
+		}
+		bands = append(bands, band)
+	}
+	return bands, nil
+}
+
+// getCalibrationTable parses a list of brightness:lux points,
+// e.g. "0.002:5,0.05:300,0.4:8000".
+func getCalibrationTable(value string) ([]CalibrationPoint, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	points := make([]CalibrationPoint, 0)
+	for _, v := range strings.Split(value, ",") {
+		brightness, lux, ok := strings.Cut(strings.TrimSpace(v), ":")
+		if !ok {
+			return nil, fmt.Errorf("point %q must be brightness:lux", v)
+		}
+		b, err := strconv.ParseFloat(strings.TrimSpace(brightness), 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing brightness of point %q: %v", v, err)
+		}
+		l, err := strconv.ParseFloat(strings.TrimSpace(lux), 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing lux of point %q: %v", v, err)
+		}
+		if b < 0 || b > 1 || l < 0 {
+			return nil, fmt.Errorf("point %q must have a brightness between 0 and 1 and non-negative lux", v)
+		}
+		points = append(points, CalibrationPoint{Brightness: b, Lux: l})
+	}
+	return points, nil
+}
+
+// getFloats parses a comma-separated list of numbers.
+func getFloats(value string) ([]float64, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	floats := make([]float64, 0)
+	for _, v := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		floats = append(floats, f)
+	}
+	return floats, nil
+}
+
+// getSchedule parses a list of HH:MM=factor entries, e.g. "07:00=1,19:30=0.1".
+func getSchedule(value string) ([]ScheduleEntry, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	entries := make([]ScheduleEntry, 0)
+	for _, v := range strings.Split(value, ",") {
+		start, factor, ok := strings.Cut(strings.TrimSpace(v), "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q must be HH:MM=factor", v)
+		}
+		t, err := time.Parse("15:04", strings.TrimSpace(start))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing start time of entry %q: %v", v, err)
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(factor), 64)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing IMAGE_CROP value: %v", err)
+			return nil, fmt.Errorf("error parsing factor of entry %q: %v", v, err)
+		}
+		if f <= 0 {
+			return nil, fmt.Errorf("factor of entry %q must be positive", v)
+		}
+		entries = append(entries, ScheduleEntry{Minute: t.Hour()*60 + t.Minute(), Factor: f})
+	}
+	return entries, nil
+}
+
+// parseInt parses the integer environment variable key.
+func parseInt(envVars map[string]*string, key string) (int, error) {
+	value, err := strconv.Atoi(*envVars[key])
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// parseFloat parses the floating point environment variable key.
+func parseFloat(envVars map[string]*string, key string) (float64, error) {
+	value, err := strconv.ParseFloat(*envVars[key], 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// topicPlaceholders lists the placeholders every topic template may use.
+var topicPlaceholders = map[string][]string{
+	"MQTT_BASE_TOPIC":         {"topic", "unique_id", "name", "camera"},
+	"MQTT_STATE_TOPIC":        {"topic", "unique_id", "name", "camera", "base"},
+	"MQTT_AVAILABILITY_TOPIC": {"topic", "unique_id", "name", "camera", "base"},
+	"MQTT_STATUS_TOPIC":       {"topic", "unique_id", "name", "camera"},
+	"MQTT_CAMERA_TOPIC":       {"topic", "unique_id", "name", "camera", "base"},
+	"HASS_DISCOVERY_TOPIC":    {"topic", "unique_id", "name", "camera", "prefix", "component", "object_id"},
+}
+
+// parseTopicTemplate checks the topic template in the environment variable
+// key for unknown placeholders and wildcards, which can't be published to.
+func parseTopicTemplate(envVars map[string]*string, key string, placeholders []string) (string, error) {
+	template := strings.TrimSpace(*envVars[key])
+	if template == "" {
+		// Only optional topics default to empty
+		return "", nil
+	}
+	if strings.ContainsAny(template, "+#") {
+		return "", fmt.Errorf("%s must not contain the wildcards + or #, got %q", key, template)
+	}
+	for rest := template; ; {
+		_, after, ok := strings.Cut(rest, "{")
+		if !ok {
+			break
+		}
+		name, after, ok := strings.Cut(after, "}")
+		if !ok {
+			return "", fmt.Errorf("%s has an unclosed placeholder, got %q", key, template)
 		}
-		crop = append(crop, intVal)
+		if !slices.Contains(placeholders, name) {
+			return "", fmt.Errorf("%s has unknown placeholder {%s}, expected one of {%s}", key, name, strings.Join(placeholders, "}, {"))
+		}
+		rest = after
 	}
+	return template, nil
+}
 
-	return &crop, nil
+// parseQoS parses the MQTT quality of service level in the environment variable key.
+func parseQoS(envVars map[string]*string, key string) (byte, error) {
+	value, err := parseInt(envVars, key)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 || value > 2 {
+		return 0, fmt.Errorf("%s must be 0, 1 or 2, got %d", key, value)
+	}
+	return byte(value), nil
+}
+
+// parseBool reports whether the environment variable key is set to "true".
+func parseBool(envVars map[string]*string, key string) bool {
+	return strings.EqualFold(*envVars[key], "true")
+}
+
+// lookupEnv returns the environment variable key, or the contents of the file
+// named by key with _FILE appended, such as a Docker or Kubernetes secret, so
+// credentials don't show up in the container configuration.
+func lookupEnv(key string) (string, error) {
+	value, path := os.Getenv(key), os.Getenv(key+"_FILE")
+	if path == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("%s and %s_FILE must not both be set", key, key)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s_FILE: %v", key, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
 }
 
 // validateEnvVars checks if required environment variables are set and assigns them to the config struct.
 func validateEnvVars(envVars map[string]*string) error {
 	for key, defaultVal := range envVars {
-		if value := os.Getenv(key); value != "" {
+		value, err := lookupEnv(key)
+		if err != nil {
+			return err
+		}
+		if value != "" {
 			envVars[key] = &value
 		} else if defaultVal == nil {
 			return fmt.Errorf("%s environment variable is not set", key)
@@ -99,10 +1417,48 @@ func validateEnvVars(envVars map[string]*string) error {
 	return nil
 }
 
-// buildMQTTHost constructs the MQTT host string with the port (default port 1883).
-func buildMQTTHost(mqttHost string) string {
+// parseMQTTProtocolVersion returns the protocol level of an MQTT version, 0
+// when it is left to negotiation between 3.1.1 and 3.1.
+func parseMQTTProtocolVersion(value string) (uint, error) {
+	switch strings.TrimSpace(value) {
+	case "":
+		return 0, nil
+	case "3.1":
+		return 3, nil
+	case "3.1.1":
+		return 4, nil
+	case "5", "5.0":
+		return 5, nil
+	default:
+		return 0, fmt.Errorf("MQTT_PROTOCOL_VERSION must be 3.1, 3.1.1 or 5, got %q", value)
+	}
+}
+
+// buildMQTTHosts constructs the broker URLs of a comma-separated list of
+// hosts. Hosts without a port of their own use MQTT_PORT, or 1883 (8883 with
+// TLS) by default.
+func buildMQTTHosts(mqttHost string, tls bool) ([]string, error) {
+	scheme, port := "tcp", "1883"
+	if tls {
+		scheme, port = "ssl", "8883"
+	}
 	if mqttPort := os.Getenv("MQTT_PORT"); mqttPort != "" {
-		return fmt.Sprintf("%s:%s", mqttHost, mqttPort)
+		port = mqttPort
+	}
+
+	hosts := make([]string, 0, 1)
+	for _, host := range strings.Split(mqttHost, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, port)
+		}
+		hosts = append(hosts, fmt.Sprintf("%s://%s", scheme, host))
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("MQTT_HOST must name at least one broker, or set MQTT_MDNS_ENABLED to discover one")
 	}
-	return fmt.Sprintf("%s:1883", mqttHost)
+	return hosts, nil
 }
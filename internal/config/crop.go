@@ -0,0 +1,231 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CropValue is a crop coordinate or size, in pixels or in percent of the
+// frame's width or height.
+type CropValue struct {
+	Value   float64
+	Percent bool
+}
+
+// Resolve returns the value in pixels for a frame dimension of the given size.
+func (v CropValue) Resolve(size int) int {
+	if v.Percent {
+		return int(v.Value/100*float64(size) + 0.5)
+	}
+	return int(v.Value)
+}
+
+func (v CropValue) String() string {
+	if v.Percent {
+		return strconv.FormatFloat(v.Value, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatFloat(v.Value, 'f', -1, 64)
+}
+
+// Anchors placing a crop against the edges or the center of the frame.
+const (
+	AnchorTopLeft     = "top-left"
+	AnchorTop         = "top"
+	AnchorTopRight    = "top-right"
+	AnchorLeft        = "left"
+	AnchorCenter      = "center"
+	AnchorRight       = "right"
+	AnchorBottomLeft  = "bottom-left"
+	AnchorBottom      = "bottom"
+	AnchorBottomRight = "bottom-right"
+)
+
+var anchors = []string{
+	AnchorTopLeft, AnchorTop, AnchorTopRight,
+	AnchorLeft, AnchorCenter, AnchorRight,
+	AnchorBottomLeft, AnchorBottom, AnchorBottomRight,
+}
+
+// cropPolygon prefixes the vertices of a polygon crop.
+const cropPolygon = "polygon"
+
+// CropPoint is a vertex of a polygon crop.
+type CropPoint struct {
+	X, Y CropValue
+}
+
+// Crop is a rectangle of the frame, placed either at X and Y or against an
+// anchor, or a polygon. A zero Width and Height select the default crop size.
+// Percentages follow the frame, so the same crop works at every snapshot
+// resolution.
+type Crop struct {
+	Anchor        string // empty when the crop is placed at X and Y
+	X, Y          CropValue
+	Width, Height CropValue
+	Polygon       []CropPoint // vertices of a polygon crop, nil for rectangles
+}
+
+// ParseCrop parses a crop such as "0,300,400,180", "10%,0%,80%,40%",
+// "top:100%,30%" for an anchored width and height, or
+// "polygon:0,0 100%,0 100%,20% 0,60%" for space-separated x,y vertices.
+// Pixels and percentages may be mixed.
+func ParseCrop(value string) (Crop, error) {
+	if anchor, size, ok := strings.Cut(value, ":"); ok {
+		anchor = strings.ToLower(strings.TrimSpace(anchor))
+		if anchor == cropPolygon {
+			return parsePolygon(size)
+		}
+		if !slices.Contains(anchors, anchor) {
+			return Crop{}, fmt.Errorf("unknown crop anchor %q, expected one of %s", anchor, strings.Join(anchors, ", "))
+		}
+		values, err := parseCropValues(size)
+		if err != nil {
+			return Crop{}, err
+		}
+		if len(values) != 2 || values[0].Value <= 0 || values[1].Value <= 0 {
+			return Crop{}, fmt.Errorf("anchored crop must be anchor:width,height with a positive size")
+		}
+		return Crop{Anchor: anchor, Width: values[0], Height: values[1]}, nil
+	}
+
+	values, err := parseCropValues(value)
+	if err != nil {
+		return Crop{}, err
+	}
+	switch len(values) {
+	case 2:
+		return Crop{X: values[0], Y: values[1]}, nil
+	case 4:
+		if values[2].Value <= 0 || values[3].Value <= 0 {
+			return Crop{}, fmt.Errorf("crop width and height must be positive, got %s,%s", values[2], values[3])
+		}
+		return Crop{X: values[0], Y: values[1], Width: values[2], Height: values[3]}, nil
+	default:
+		return Crop{}, fmt.Errorf("crop must be x,y or x,y,width,height, got %d values", len(values))
+	}
+}
+
+// parsePolygon parses the space-separated x,y vertices of a polygon crop.
+func parsePolygon(value string) (Crop, error) {
+	vertices := strings.Fields(value)
+	if len(vertices) < 3 {
+		return Crop{}, fmt.Errorf("polygon crop needs at least three x,y vertices, got %d", len(vertices))
+	}
+	polygon := make([]CropPoint, 0, len(vertices))
+	for _, v := range vertices {
+		values, err := parseCropValues(v)
+		if err != nil {
+			return Crop{}, err
+		}
+		if len(values) != 2 {
+			return Crop{}, fmt.Errorf("polygon vertex %q must be x,y", v)
+		}
+		polygon = append(polygon, CropPoint{X: values[0], Y: values[1]})
+	}
+	return Crop{Polygon: polygon}, nil
+}
+
+// parseCropValues parses a comma-separated list of pixels and percentages.
+func parseCropValues(value string) ([]CropValue, error) {
+	crop := make([]CropValue, 0, 4)
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if number, ok := strings.CutSuffix(v, "%"); ok {
+			percent, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid crop percentage %q", v)
+			}
+			if percent < 0 || percent > 100 {
+				return nil, fmt.Errorf("crop percentage %q must be between 0%% and 100%%", v)
+			}
+			crop = append(crop, CropValue{Value: percent, Percent: true})
+			continue
+		}
+		pixels, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid crop value %q", v)
+		}
+		crop = append(crop, CropValue{Value: float64(pixels)})
+	}
+	return crop, nil
+}
+
+// HasSize reports whether the crop has its own width and height.
+func (c Crop) HasSize() bool {
+	return c.Width != CropValue{} || c.Height != CropValue{}
+}
+
+func (c Crop) String() string {
+	if c.Polygon != nil {
+		vertices := make([]string, len(c.Polygon))
+		for i, v := range c.Polygon {
+			vertices[i] = fmt.Sprintf("%s,%s", v.X, v.Y)
+		}
+		return cropPolygon + ":" + strings.Join(vertices, " ")
+	}
+	if c.Anchor != "" {
+		return fmt.Sprintf("%s:%s,%s", c.Anchor, c.Width, c.Height)
+	}
+	if !c.HasSize() {
+		return fmt.Sprintf("%s,%s", c.X, c.Y)
+	}
+	return fmt.Sprintf("%s,%s,%s,%s", c.X, c.Y, c.Width, c.Height)
+}
+
+// Crops are rectangles of the frame whose pixels are combined into one
+// measurement.
+type Crops []Crop
+
+// ParseCrops parses a semicolon-separated list of crops, such as
+// "0,0,30%,40%;70%,0,30%,40%".
+func ParseCrops(value string) (Crops, error) {
+	crops := make(Crops, 0, 1)
+	for _, v := range strings.Split(value, ";") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		crop, err := ParseCrop(v)
+		if err != nil {
+			return nil, err
+		}
+		crops = append(crops, crop)
+	}
+	if len(crops) == 0 {
+		return nil, fmt.Errorf("no crop given")
+	}
+	return crops, nil
+}
+
+func (c Crops) String() string {
+	values := make([]string, len(c))
+	for i, crop := range c {
+		values[i] = crop.String()
+	}
+	return strings.Join(values, ";")
+}
+
+// MarshalJSON writes the crops in the same format as IMAGE_CROP.
+func (c Crops) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+// UnmarshalJSON reads crops written by MarshalJSON.
+func (c *Crops) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	if value == "" {
+		*c = Crops{}
+		return nil
+	}
+	crops, err := ParseCrops(value)
+	if err != nil {
+		return err
+	}
+	*c = crops
+	return nil
+}
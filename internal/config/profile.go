@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Profile is a named set of calibration settings exported from one instance
+// and imported on another with CALIBRATION_PROFILE, so cameras of the same
+// model can share their tuning.
+type Profile struct {
+	Name             string             `json:"name"`
+	Curve            string             `json:"curve"`
+	LuxScale         float64            `json:"lux_scale,omitempty"`
+	Table            []CalibrationPoint `json:"table,omitempty"`
+	Coefficients     []float64          `json:"coefficients,omitempty"`
+	Crop             Crops              `json:"crop,omitempty"`
+	DarkThresholdOn  float64            `json:"dark_threshold_on"`
+	DarkThresholdOff float64            `json:"dark_threshold_off"`
+}
+
+// NewProfile captures the calibration settings of the configuration.
+func NewProfile(name string, c *Config) *Profile {
+	p := &Profile{
+		Name:             name,
+		Curve:            c.CalibrationCurve,
+		LuxScale:         c.LuxScale,
+		Table:            c.CalibrationTable,
+		Coefficients:     c.CalibrationCoefficients,
+		DarkThresholdOn:  c.DarkThresholdOn,
+		DarkThresholdOff: c.DarkThresholdOff,
+	}
+	p.Crop = c.ImageCrop
+	return p
+}
+
+// LoadProfile reads a calibration profile.
+func LoadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read calibration profile: %w", err)
+	}
+
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse calibration profile: %w", err)
+	}
+	return &p, nil
+}
+
+// Save writes the calibration profile.
+func (p *Profile) Save(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal calibration profile: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write calibration profile: %w", err)
+	}
+	return nil
+}
+
+// Apply replaces the calibration settings of the configuration with the
+// ones in the profile.
+func (p *Profile) Apply(c *Config) error {
+	switch p.Curve {
+	case CurveLinear:
+		if p.LuxScale <= 0 {
+			return fmt.Errorf("profile %q has no positive lux scale", p.Name)
+		}
+	case CurveTable:
+		if len(p.Table) < 2 {
+			return fmt.Errorf("profile %q needs at least two table points", p.Name)
+		}
+	case CurvePower, CurveLog:
+		if len(p.Coefficients) != 2 {
+			return fmt.Errorf("profile %q needs two coefficients for its %s curve", p.Name, p.Curve)
+		}
+	default:
+		return fmt.Errorf("profile %q has unknown calibration curve %q", p.Name, p.Curve)
+	}
+	if p.DarkThresholdOff < p.DarkThresholdOn {
+		return fmt.Errorf("profile %q dark threshold off (%v) must not be below on (%v)", p.Name, p.DarkThresholdOff, p.DarkThresholdOn)
+	}
+
+	c.CalibrationCurve = p.Curve
+	if p.LuxScale > 0 {
+		c.LuxScale = p.LuxScale
+	}
+	c.CalibrationTable = p.Table
+	c.CalibrationCoefficients = p.Coefficients
+	if p.Crop != nil {
+		c.ImageCrop = p.Crop
+	}
+	c.DarkThresholdOn = p.DarkThresholdOn
+	c.DarkThresholdOff = p.DarkThresholdOff
+	return nil
+}
@@ -0,0 +1,30 @@
+package filter
+
+import "math"
+
+// DeadBand suppresses changes too small to be worth publishing, such as a
+// reading jittering by a couple of lux between intervals.
+type DeadBand struct {
+	absolute float64
+	percent  float64
+	last     float64
+	started  bool
+}
+
+// NewDeadBand creates a dead band ignoring changes of up to absolute lux or
+// percent of the last published value, whichever is larger.
+func NewDeadBand(absolute, percent float64) *DeadBand {
+	return &DeadBand{absolute: absolute, percent: percent}
+}
+
+// Exceeded reports whether value moved outside the dead band around the last
+// published value, in which case it becomes the new reference.
+func (d *DeadBand) Exceeded(value float64) bool {
+	band := math.Max(d.absolute, math.Abs(d.last)*d.percent/100)
+	if d.started && math.Abs(value-d.last) <= band {
+		return false
+	}
+	d.last = value
+	d.started = true
+	return true
+}
@@ -0,0 +1,25 @@
+package filter
+
+// EMA is an exponential moving average filter.
+type EMA struct {
+	alpha   float64
+	value   float64
+	started bool
+}
+
+// NewEMA creates an exponential moving average with the given smoothing factor.
+// An alpha close to 1 follows new readings closely, close to 0 smooths heavily.
+func NewEMA(alpha float64) *EMA {
+	return &EMA{alpha: alpha}
+}
+
+// Update adds a reading and returns the new average.
+func (e *EMA) Update(value float64) float64 {
+	if !e.started {
+		e.value = value
+		e.started = true
+		return e.value
+	}
+	e.value += e.alpha * (value - e.value)
+	return e.value
+}
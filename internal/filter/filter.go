@@ -0,0 +1,36 @@
+package filter
+
+import (
+	"fmt"
+
+	"dark-detector/internal/config"
+)
+
+// Filter smooths a series of lux readings.
+type Filter interface {
+	// Update adds a reading and returns the smoothed value.
+	Update(value float64) float64
+}
+
+// New creates the smoothing filter selected in the configuration.
+func New(cfg *config.Config) (Filter, error) {
+	switch cfg.Smoothing {
+	case config.SmoothingNone:
+		return passthrough{}, nil
+	case config.SmoothingEMA:
+		return NewEMA(cfg.SmoothingAlpha), nil
+	case config.SmoothingMedian:
+		return NewMedian(cfg.SmoothingWindow), nil
+	case config.SmoothingKalman:
+		return NewKalman(cfg.KalmanProcessNoise, cfg.KalmanMeasurementNoise), nil
+	default:
+		return nil, fmt.Errorf("unknown smoothing mode %q", cfg.Smoothing)
+	}
+}
+
+// passthrough returns readings unchanged.
+type passthrough struct{}
+
+func (passthrough) Update(value float64) float64 {
+	return value
+}
@@ -0,0 +1,61 @@
+package filter
+
+import "math"
+
+// adaptiveGate is the squared number of standard deviations a reading may
+// deviate from the prediction before it counts as a possible transition.
+const adaptiveGate = 9
+
+// Kalman is a one-dimensional Kalman filter over log-scaled lux. Working in
+// log space keeps the noise parameters meaningful from night to full daylight.
+// A single outlier is damped like noise, but consecutive readings that disagree
+// with the estimate are treated as a genuine transition (dawn, dusk, a storm
+// rolling in) and the filter widens its uncertainty to follow them quickly.
+type Kalman struct {
+	processNoise     float64
+	measurementNoise float64
+	estimate         float64
+	errorCovariance  float64
+	deviations       int
+	started          bool
+}
+
+// NewKalman creates a Kalman filter with the given process and measurement noise variances.
+func NewKalman(processNoise, measurementNoise float64) *Kalman {
+	return &Kalman{
+		processNoise:     processNoise,
+		measurementNoise: measurementNoise,
+	}
+}
+
+// Update adds a reading and returns the filtered value.
+func (k *Kalman) Update(value float64) float64 {
+	measurement := math.Log1p(math.Max(value, 0))
+	if !k.started {
+		k.estimate = measurement
+		k.errorCovariance = k.measurementNoise
+		k.started = true
+		return value
+	}
+
+	// Predict
+	covariance := k.errorCovariance + k.processNoise
+	innovation := measurement - k.estimate
+
+	// Adapt to sustained deviations
+	if innovation*innovation > adaptiveGate*(covariance+k.measurementNoise) {
+		k.deviations++
+	} else {
+		k.deviations = 0
+	}
+	if k.deviations >= 2 {
+		covariance += innovation * innovation
+	}
+
+	// Correct
+	gain := covariance / (covariance + k.measurementNoise)
+	k.estimate += gain * innovation
+	k.errorCovariance = (1 - gain) * covariance
+
+	return math.Expm1(k.estimate)
+}
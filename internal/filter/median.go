@@ -0,0 +1,39 @@
+package filter
+
+import "sort"
+
+// Median is a rolling median over the last N readings. Unlike an average it
+// ignores single-frame spikes entirely instead of damping them.
+type Median struct {
+	window []float64
+	size   int
+	next   int
+}
+
+// NewMedian creates a rolling median over the given number of readings.
+func NewMedian(size int) *Median {
+	return &Median{
+		window: make([]float64, 0, size),
+		size:   size,
+	}
+}
+
+// Update adds a reading and returns the median of the current window.
+func (m *Median) Update(value float64) float64 {
+	if len(m.window) < m.size {
+		m.window = append(m.window, value)
+	} else {
+		m.window[m.next] = value
+	}
+	m.next = (m.next + 1) % m.size
+
+	sorted := make([]float64, len(m.window))
+	copy(sorted, m.window)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
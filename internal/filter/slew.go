@@ -0,0 +1,28 @@
+package filter
+
+import "math"
+
+// SlewLimit limits how far the value can move per reading, so a sudden step
+// such as an IR-cut filter toggling ramps over several intervals instead.
+type SlewLimit struct {
+	maxStep float64
+	value   float64
+	started bool
+}
+
+// NewSlewLimit creates a limiter allowing the value to change by at most
+// maxStep per reading.
+func NewSlewLimit(maxStep float64) *SlewLimit {
+	return &SlewLimit{maxStep: maxStep}
+}
+
+// Update adds a reading and returns the rate-limited value.
+func (s *SlewLimit) Update(value float64) float64 {
+	if !s.started {
+		s.value = value
+		s.started = true
+		return s.value
+	}
+	s.value += math.Max(-s.maxStep, math.Min(s.maxStep, value-s.value))
+	return s.value
+}
@@ -0,0 +1,108 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"dark-detector/internal/config"
+)
+
+// Colors the areas are outlined with on an annotated frame.
+var (
+	cropColor    = color.RGBA{R: 0x30, G: 0xe0, B: 0x50, A: 0xff}
+	excludeColor = color.RGBA{R: 0xff, G: 0x40, B: 0x40, A: 0xff}
+	regionColor  = color.RGBA{R: 0xff, G: 0xc0, B: 0x20, A: 0xff}
+)
+
+// Annotated returns the latest frame before cropping with the pixels left out
+// of the measurement dimmed, as in the preview, and the crops, exclusions and
+// regions outlined on top. It is nil before the first frame.
+func (p *Processor) Annotated() image.Image {
+	frame := p.LastFrame()
+	if frame == nil {
+		return nil
+	}
+	bounds := frame.Bounds()
+
+	// Crops that don't resolve fail the reading itself, so they are simply
+	// left out of the picture
+	weights := make([]float64, bounds.Dx()*bounds.Dy())
+	if len(p.imageCrop) == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+	} else {
+		_ = fillCrops(weights, bounds, bounds, p.imageCrop, 1)
+	}
+	if p.imageMask != nil {
+		if masked, err := combineWeights(weights, p.imageMask.weights(bounds, bounds)); err == nil {
+			weights = masked
+		}
+	}
+	if p.imageExclude != nil {
+		_ = fillCrops(weights, bounds, bounds, p.imageExclude, 0)
+	}
+	// The preview always draws a new image when there is a mask
+	out := (&measured{img: frame, mask: weights}).preview().(*image.RGBA)
+
+	thickness := max(1, min(bounds.Dx(), bounds.Dy())/240)
+	for _, crop := range p.imageExclude {
+		drawOutline(out, bounds, crop, thickness, excludeColor)
+	}
+	for _, region := range p.regions {
+		drawOutline(out, bounds, region.Crop, thickness, regionColor)
+	}
+	for _, crop := range p.imageCrop {
+		drawOutline(out, bounds, crop, thickness, cropColor)
+	}
+	return out
+}
+
+// drawOutline draws the edges of a rectangle or polygon crop of a frame with
+// the given bounds onto out, which holds the frame moved to the origin.
+func drawOutline(out *image.RGBA, frame image.Rectangle, crop config.Crop, thickness int, c color.RGBA) {
+	var vertices []point
+	if crop.Polygon != nil {
+		// Vertices on the far edges of the frame lie just beyond its pixels
+		vertices = polygonVertices(crop.Polygon, frame)
+		for i, v := range vertices {
+			vertices[i].x = math.Min(v.x, float64(frame.Max.X-1))
+			vertices[i].y = math.Min(v.y, float64(frame.Max.Y-1))
+		}
+	} else {
+		rect, err := cropRect(frame, crop)
+		if err != nil {
+			return
+		}
+		// Keep the edges on the last pixels within the crop
+		x1, y1 := float64(rect.Min.X), float64(rect.Min.Y)
+		x2, y2 := float64(rect.Max.X-1), float64(rect.Max.Y-1)
+		vertices = []point{{x1, y1}, {x2, y1}, {x2, y2}, {x1, y2}}
+	}
+	for i, a := range vertices {
+		b := vertices[(i+1)%len(vertices)]
+		drawLine(out, a.x-float64(frame.Min.X), a.y-float64(frame.Min.Y),
+			b.x-float64(frame.Min.X), b.y-float64(frame.Min.Y), thickness, c)
+	}
+}
+
+// drawLine draws a line of the given thickness from (x1, y1) to (x2, y2),
+// stamping a square every pixel along it.
+func drawLine(out *image.RGBA, x1, y1, x2, y2 float64, thickness int, c color.RGBA) {
+	steps := int(math.Ceil(math.Max(math.Abs(x2-x1), math.Abs(y2-y1))))
+	for i := 0; i <= steps; i++ {
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		x := int(math.Round(x1+t*(x2-x1))) - thickness/2
+		y := int(math.Round(y1+t*(y2-y1))) - thickness/2
+		for dy := 0; dy < thickness; dy++ {
+			for dx := 0; dx < thickness; dx++ {
+				// Pixels beyond the frame are ignored
+				out.SetRGBA(x+dx, y+dy, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package image
+
+import (
+	"fmt"
+)
+
+// dominantColorBits is the number of bits per channel kept when binning
+// colors to find the dominant one
+const dominantColorBits = 4
+
+// sRGB (D65) linear RGB to CIE XYZ conversion
+const (
+	xFromR, xFromG, xFromB = 0.4124, 0.3576, 0.1805
+	yFromR, yFromG, yFromB = 0.2126, 0.7152, 0.0722
+	zFromR, zFromG, zFromB = 0.0193, 0.1192, 0.9505
+)
+
+// correlatedColorTemperature estimates the correlated color temperature in
+// kelvin from linear RGB (any common scale), using McCamy's approximation on
+// the CIE 1931 chromaticity. It returns 0 for black.
+func correlatedColorTemperature(r, g, b float64) float64 {
+	x := xFromR*r + xFromG*g + xFromB*b
+	y := yFromR*r + yFromG*g + yFromB*b
+	z := zFromR*r + zFromG*g + zFromB*b
+	sum := x + y + z
+	if sum <= 0 {
+		return 0
+	}
+
+	cx, cy := x/sum, y/sum
+	n := (cx - 0.3320) / (0.1858 - cy)
+	return 449*n*n*n + 3525*n*n + 6823.3*n + 5520.33
+}
+
+// colorBin sums the pixels falling into one coarse RGB bin.
+type colorBin struct {
+	count   int
+	r, g, b uint64
+}
+
+// colorBins is a coarse RGB histogram used to find the dominant color.
+type colorBins struct {
+	bins [1 << (3 * dominantColorBits)]colorBin
+	peak *colorBin
+}
+
+// add records a pixel from its 16-bit channel values.
+func (c *colorBins) add(r, g, b uint32) {
+	const shift = 16 - dominantColorBits
+	bin := &c.bins[(r>>shift)<<(2*dominantColorBits)|(g>>shift)<<dominantColorBits|b>>shift]
+	bin.count++
+	bin.r += uint64(r)
+	bin.g += uint64(g)
+	bin.b += uint64(b)
+	if c.peak == nil || bin.count > c.peak.count {
+		c.peak = bin
+	}
+}
+
+// dominant returns the average color of the fullest bin as a hex string such
+// as "#f0a040", or an empty string when no pixels were added.
+func (c *colorBins) dominant() string {
+	if c.peak == nil {
+		return ""
+	}
+	n := uint64(c.peak.count)
+	return fmt.Sprintf("#%02x%02x%02x", c.peak.r/n>>8, c.peak.g/n>>8, c.peak.b/n>>8)
+}
@@ -0,0 +1,112 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// downscale shrinks the image by an integer factor, averaging every block of
+// factor×factor pixels into one, along with the mask of the pixels to meter.
+// Blocks at the right and bottom edges may be smaller. Pixels are averaged in
+// linear light, decoded with the lookup table, so the brightness of the frame
+// is kept, and the result is encoded again with 16 bits per channel.
+func downscale(img image.Image, mask []float64, factor int, linearLUT []float64) (image.Image, []float64) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := (width+factor-1)/factor, (height+factor-1)/factor
+
+	// Sum the linear channels of every block
+	sums := make([]float64, outWidth*outHeight*3)
+	forEachPixel(img, func(x, y int, r, g, b uint32) {
+		i := ((y/factor)*outWidth + x/factor) * 3
+		sums[i] += linearLUT[r]
+		sums[i+1] += linearLUT[g]
+		sums[i+2] += linearLUT[b]
+	})
+
+	out := image.NewRGBA64(image.Rect(0, 0, outWidth, outHeight))
+	var outMask []float64
+	if mask != nil {
+		outMask = make([]float64, outWidth*outHeight)
+	}
+	for oy := 0; oy < outHeight; oy++ {
+		blockHeight := min(factor, height-oy*factor)
+		for ox := 0; ox < outWidth; ox++ {
+			blockWidth := min(factor, width-ox*factor)
+			n := float64(blockWidth * blockHeight)
+			i := (oy*outWidth + ox) * 3
+			out.SetRGBA64(ox, oy, color.RGBA64{
+				R: encodeLinear(linearLUT, sums[i]/n),
+				G: encodeLinear(linearLUT, sums[i+1]/n),
+				B: encodeLinear(linearLUT, sums[i+2]/n),
+				A: 0xffff,
+			})
+			if mask != nil {
+				weight := 0.0
+				for y := oy * factor; y < oy*factor+blockHeight; y++ {
+					for x := ox * factor; x < ox*factor+blockWidth; x++ {
+						weight += mask[y*width+x]
+					}
+				}
+				outMask[oy*outWidth+ox] = weight / n
+			}
+		}
+	}
+	return out, outMask
+}
+
+// encodeLinear returns the 16-bit channel value whose linear light in the
+// lookup table is closest to v.
+func encodeLinear(linearLUT []float64, v float64) uint16 {
+	i := sort.SearchFloat64s(linearLUT, v)
+	if i == len(linearLUT) {
+		return 0xffff
+	}
+	if i > 0 && v-linearLUT[i-1] < linearLUT[i]-v {
+		i--
+	}
+	return uint16(i)
+}
+
+// forEachPixel calls fn with the 16-bit channels of every pixel, at (x, y)
+// relative to the image origin. Like measure, it reads the pixel buffers of
+// common image types directly.
+func forEachPixel(img image.Image, fn func(x, y int, r, g, b uint32)) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	switch img := img.(type) {
+	case *image.RGBA:
+		for y := 0; y < height; y++ {
+			offset := y * img.Stride
+			for x := 0; x < width; x++ {
+				i := offset + x*4
+				fn(x, y, uint32(img.Pix[i+0])*257, uint32(img.Pix[i+1])*257, uint32(img.Pix[i+2])*257)
+			}
+		}
+	case *image.YCbCr:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				px, py := x+bounds.Min.X, y+bounds.Min.Y
+				yi, ci := img.YOffset(px, py), img.COffset(px, py)
+				r, g, b, _ := color.YCbCr{Y: img.Y[yi], Cb: img.Cb[ci], Cr: img.Cr[ci]}.RGBA()
+				fn(x, y, r, g, b)
+			}
+		}
+	case *image.Gray:
+		for y := 0; y < height; y++ {
+			offset := y * img.Stride
+			for x := 0; x < width; x++ {
+				v := uint32(img.Pix[offset+x]) * 257
+				fn(x, y, v, v, v)
+			}
+		}
+	default:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				r, g, b, _ := img.At(x+bounds.Min.X, y+bounds.Min.Y).RGBA()
+				fn(x, y, r, g, b)
+			}
+		}
+	}
+}
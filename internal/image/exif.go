@@ -0,0 +1,184 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// EXIF tags read from the camera metadata
+const (
+	tagOrientation    = 0x0112
+	tagExifIFDPointer = 0x8769
+	tagExposureTime   = 0x829A
+	tagFNumber        = 0x829D
+	tagISOSpeed       = 0x8827
+)
+
+// TIFF field types
+const (
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+// Exposure compensation parameters
+const (
+	incidentLightConstant = 250  // Incident-light meter calibration constant (C)
+	midGrey               = 0.18 // Reflectance a metered exposure renders as mid grey
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifData holds the exposure settings the camera used for a frame and how
+// the frame is oriented.
+type exifData struct {
+	exposureTime float64 // seconds
+	fNumber      float64
+	iso          float64
+	orientation  int // EXIF orientation tag, 0 when missing
+}
+
+// hasExposure reports whether all values needed for exposure compensation are present.
+func (e *exifData) hasExposure() bool {
+	return e != nil && e.exposureTime > 0 && e.fNumber > 0 && e.iso > 0
+}
+
+// exposureLux back-computes scene illuminance from the exposure settings.
+// An auto-exposing camera renders the metered scene as mid grey, so the
+// illuminance implied by the exposure is scaled by how far the measured
+// brightness is from mid grey.
+func (e *exifData) exposureLux(brightness float64) float64 {
+	exposureIlluminance := incidentLightConstant * e.fNumber * e.fNumber / (e.exposureTime * e.iso)
+	return exposureIlluminance * brightness / midGrey
+}
+
+// parseExif extracts exposure and orientation metadata from the APP1 segment of a JPEG.
+// It returns nil without error when the image carries no EXIF data.
+func parseExif(data []byte) (*exifData, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return nil, errors.New("invalid JPEG segment marker")
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image, metadata segments come before
+			return nil, nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, exifHeader) {
+			return parseTIFF(segment[len(exifHeader):])
+		}
+		pos = end
+	}
+
+	return nil, nil
+}
+
+// tiffReader reads IFD entries from an EXIF TIFF structure.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // the raw 4-byte value/offset field
+}
+
+func parseTIFF(data []byte) (*exifData, error) {
+	if len(data) < 8 {
+		return nil, errors.New("truncated TIFF header")
+	}
+
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid TIFF byte order")
+	}
+
+	ifd0, err := t.readIFD(t.order.Uint32(data[4:8]))
+	if err != nil {
+		return nil, err
+	}
+
+	exif := &exifData{orientation: int(t.number(ifd0[tagOrientation]))}
+	entries := ifd0
+	if pointer, ok := ifd0[tagExifIFDPointer]; ok {
+		subIFD, err := t.readIFD(t.order.Uint32(pointer.value))
+		if err != nil {
+			return nil, err
+		}
+		entries = subIFD
+	}
+
+	exif.exposureTime = t.number(entries[tagExposureTime])
+	exif.fNumber = t.number(entries[tagFNumber])
+	exif.iso = t.number(entries[tagISOSpeed])
+	return exif, nil
+}
+
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]ifdEntry, error) {
+	if int(offset)+2 > len(t.data) {
+		return nil, errors.New("IFD offset out of range")
+	}
+
+	count := int(t.order.Uint16(t.data[offset:]))
+	start := int(offset) + 2
+	if start+count*12 > len(t.data) {
+		return nil, errors.New("truncated IFD")
+	}
+
+	entries := make(map[uint16]ifdEntry, count)
+	for i := 0; i < count; i++ {
+		raw := t.data[start+i*12 : start+(i+1)*12]
+		entries[t.order.Uint16(raw[0:2])] = ifdEntry{
+			typ:   t.order.Uint16(raw[2:4]),
+			count: t.order.Uint32(raw[4:8]),
+			value: raw[8:12],
+		}
+	}
+	return entries, nil
+}
+
+// number reads the first value of a SHORT, LONG or RATIONAL entry.
+// Missing or unsupported entries read as 0.
+func (t *tiffReader) number(entry ifdEntry) float64 {
+	if entry.count == 0 {
+		return 0
+	}
+
+	switch entry.typ {
+	case tiffShort:
+		return float64(t.order.Uint16(entry.value))
+	case tiffLong:
+		return float64(t.order.Uint32(entry.value))
+	case tiffRational:
+		offset := int(t.order.Uint32(entry.value))
+		if offset+8 > len(t.data) {
+			return 0
+		}
+		numerator := t.order.Uint32(t.data[offset:])
+		denominator := t.order.Uint32(t.data[offset+4:])
+		if denominator == 0 {
+			return 0
+		}
+		return float64(numerator) / float64(denominator)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,24 @@
+package image
+
+// Perceptual hash grid, one column wider than tall so each row yields 8 comparisons
+const (
+	hashWidth  = 9
+	hashHeight = 8
+)
+
+// perceptualHash computes a 64-bit difference hash (dHash) from a 9x8 grid of
+// average luma. Each bit records whether a cell is brighter than its right
+// neighbour, so re-encoded copies of the same frame hash identically while
+// real scene changes flip bits.
+func perceptualHash(grid *lumaPlane) uint64 {
+	var hash uint64
+	for row := 0; row < hashHeight; row++ {
+		for col := 0; col < hashWidth-1; col++ {
+			hash <<= 1
+			if grid.at(col, row) > grid.at(col+1, row) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
@@ -1,85 +1,185 @@
 package image
 
 import (
-	"errors"
-	"image"
+	"fmt"
 	_ "image/jpeg"
 	_ "image/png"
 	"math"
+	"sort"
+	"sync"
+
+	"dark-detector/internal/calibration"
 )
 
 // Lux calculation parameters
 const (
-	luxScale        = 9500 // Empirical scaling factor (adjust based on calibration)
 	srgbThreshold   = 0.04045
 	srgbLinearScale = 12.92
 	srgbExpScale    = 1.055
 	srgbExpOffset   = 0.055
 	srgbGamma       = 2.4
 	scale           = 65535.0
-	rWeight         = 0.2126
-	gWeight         = 0.7152
-	bWeight         = 0.0722
 	toPercent       = 100
+	cieDelta        = 6.0 / 29.0
+	cieEpsilon      = cieDelta * cieDelta * cieDelta
 )
 
-// calcLux calculates the average luminance of an image in lux.
-func calcLux(img image.Image) (int, error) {
-	bounds := img.Bounds()
-	if bounds.Empty() {
-		return 0, errors.New("image has no pixels to process")
-	}
-	width, height := bounds.Dx(), bounds.Dy()
+// Transfer functions used to decode pixel values to linear light.
+const (
+	TransferSRGB   = "srgb"
+	TransferGamma  = "gamma"
+	TransferLinear = "linear"
+)
+
+// Luma coefficient sets used to weight the color channels.
+const (
+	LumaBT601  = "bt601"
+	LumaBT709  = "bt709"
+	LumaBT2020 = "bt2020"
+)
 
-	// Optimized path for RGBA images
-	if rgba, ok := img.(*image.RGBA); ok {
-		return calcLuxRGBA(rgba, width, height)
+// lumaCoefficients weight the red, green and blue channels into luminance.
+type lumaCoefficients struct {
+	r, g, b float64
+}
+
+// newLumaCoefficients returns the weights of the named standard. BT.601 matches
+// the YCbCr encoding of most camera JPEGs, BT.709 the sRGB primaries and
+// BT.2020 wide-gamut sources.
+func newLumaCoefficients(name string) (lumaCoefficients, error) {
+	switch name {
+	case LumaBT601:
+		return lumaCoefficients{r: 0.299, g: 0.587, b: 0.114}, nil
+	case LumaBT709:
+		return lumaCoefficients{r: 0.2126, g: 0.7152, b: 0.0722}, nil
+	case LumaBT2020:
+		return lumaCoefficients{r: 0.2627, g: 0.6780, b: 0.0593}, nil
+	default:
+		return lumaCoefficients{}, fmt.Errorf("unknown luma coefficients %q", name)
 	}
+}
 
-	totalBrightness := 0.0
-	pixels := width * height
+// luxOptions controls how pixels are decoded and aggregated into a single value.
+type luxOptions struct {
+	scale         float64   // empirical factor converting brightness to lux
+	linearLUT     []float64 // linear light for every 16-bit channel value
+	coefficients  lumaCoefficients
+	trimPercent   float64    // percentage of darkest and brightest pixels to discard
+	clipThreshold float64    // linear luminance above which pixels are clipped, 0 disables
+	metering      metering   // how pixels are weighted across the frame
+	mask          []float64  // pixels of the cropped image to meter, nil when all of them count
+	flatField     *flatField // black level and vignetting correction, nil when not calibrated
+	bufferPool    *sync.Pool // pool of []sample used to hold samples when trimming
+}
 
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, _ := img.At(x+bounds.Min.X, y+bounds.Min.Y).RGBA()
-			// Convert 16-bit color to linear RGB
-			rLinear := srgbToLinear(float64(r) / scale)
-			gLinear := srgbToLinear(float64(g) / scale)
-			bLinear := srgbToLinear(float64(b) / scale)
+// sample is the luminance of a single pixel and the weight it is metered with.
+type sample struct {
+	y      float64
+	weight float64
+}
 
-			// Calculate luminance using BT.709 coefficients
-			totalBrightness += rLinear*rWeight + gLinear*gWeight + bLinear*bWeight
+// luminanceAccumulator sums weighted per-pixel luminance, applying clipping and
+// keeping the individual samples when a trimmed mean is requested.
+type luminanceAccumulator struct {
+	opts    luxOptions
+	total   float64
+	weight  float64
+	samples []sample
+}
+
+func newLuminanceAccumulator(opts luxOptions, pixels int) *luminanceAccumulator {
+	acc := &luminanceAccumulator{opts: opts}
+	if opts.trimPercent > 0 {
+		if opts.bufferPool != nil {
+			acc.samples = opts.bufferPool.Get().([]sample)[:0]
+		}
+		if cap(acc.samples) < pixels {
+			acc.samples = make([]sample, 0, pixels)
 		}
 	}
-
-	return scaleLux(totalBrightness, pixels), nil
+	return acc
 }
 
-// calcLuxRGBA calculates the average luminance of an RGBA image in lux.
-func calcLuxRGBA(img *image.RGBA, width, height int) (int, error) {
-	totalBrightness := 0.0
-	pixels := width * height
+// add records the linear luminance of a single pixel with the given weight.
+func (a *luminanceAccumulator) add(y, weight float64) {
+	if a.opts.clipThreshold > 0 && y > a.opts.clipThreshold {
+		y = a.opts.clipThreshold
+	}
+	if a.samples != nil {
+		a.samples = append(a.samples, sample{y: y, weight: weight})
+		return
+	}
+	a.total += y * weight
+	a.weight += weight
+}
 
-	// Precompute lookup table for 8-bit sRGB to linear conversion
-	var srgbToLinearLUT [256]float64
-	for i := range srgbToLinearLUT {
-		srgbToLinearLUT[i] = srgbToLinear(float64(i) / 255.0)
+// result returns the weighted sum of luminance and the total weight it covers,
+// discarding the trimmed tails when trimming is enabled. Trimming removes the
+// given percentage of the total weight from each end.
+func (a *luminanceAccumulator) result() (float64, float64) {
+	if a.samples == nil {
+		return a.total, a.weight
 	}
+	defer a.release()
 
-	for y := 0; y < height; y++ {
-		offset := y * img.Stride
-		for x := 0; x < width; x++ {
-			i := offset + x*4
-			// Use lookup table for faster conversion
-			r := srgbToLinearLUT[img.Pix[i+0]]
-			g := srgbToLinearLUT[img.Pix[i+1]]
-			b := srgbToLinearLUT[img.Pix[i+2]]
+	if len(a.samples) == 0 {
+		return 0, 0
+	}
+	sort.Slice(a.samples, func(i, j int) bool { return a.samples[i].y < a.samples[j].y })
+	weight := 0.0
+	for _, s := range a.samples {
+		weight += s.weight
+	}
+	trim := weight * a.opts.trimPercent / toPercent
 
-			totalBrightness += r*rWeight + g*gWeight + b*bWeight
+	// Walk the sorted samples, keeping only the weight between the trimmed tails
+	total, kept, seen := 0.0, 0.0, 0.0
+	for _, s := range a.samples {
+		lo, hi := seen, seen+s.weight
+		seen = hi
+		w := math.Min(hi, weight-trim) - math.Max(lo, trim)
+		if w > 0 {
+			total += s.y * w
+			kept += w
 		}
 	}
+	return total, kept
+}
+
+// release returns the sample buffer to the pool for reuse.
+func (a *luminanceAccumulator) release() {
+	if a.opts.bufferPool != nil {
+		a.opts.bufferPool.Put(a.samples[:0])
+	}
+	a.samples = nil
+}
 
-	return scaleLux(totalBrightness, pixels), nil
+// newTransferFunction returns the decoder for the named transfer function.
+func newTransferFunction(name string, gamma float64) (func(c float64) float64, error) {
+	switch name {
+	case TransferSRGB:
+		return srgbToLinear, nil
+	case TransferGamma:
+		return func(c float64) float64 {
+			return math.Pow(c, gamma)
+		}, nil
+	case TransferLinear:
+		return func(c float64) float64 {
+			return c
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transfer function %q", name)
+	}
+}
+
+// newLinearLUT precomputes the transfer function for every 16-bit channel value,
+// so decoding a pixel to linear light is a table lookup.
+func newLinearLUT(toLinear func(c float64) float64) []float64 {
+	lut := make([]float64, 1<<16)
+	for i := range lut {
+		lut[i] = toLinear(float64(i) / scale)
+	}
+	return lut
 }
 
 // srgbToLinear converts an sRGB color value to linear RGB.
@@ -90,11 +190,38 @@ func srgbToLinear(c float64) float64 {
 	return math.Pow((c+srgbExpOffset)/srgbExpScale, srgbGamma)
 }
 
-// scaleLux scales the average brightness to lux.
-func scaleLux(totalBrightness float64, pixels int) int {
-	if pixels == 0 {
+// averageBrightness divides the summed luminance by the total weight of the pixels.
+func averageBrightness(totalBrightness, weight float64) float64 {
+	if weight == 0 {
 		return 0
 	}
-	avgBrightness := totalBrightness / float64(pixels)
-	return int(avgBrightness * luxScale)
+	return totalBrightness / weight
+}
+
+// scaleLux converts the average brightness to lux using the calibration curve.
+func scaleLux(avgBrightness float64, curve calibration.Curve) int {
+	return int(curve.Lux(avgBrightness))
+}
+
+// ExposureValue converts illuminance in lux to an incident-light exposure
+// value at ISO 100. Readings below 1 lx are treated as 1 lx.
+func ExposureValue(lux float64) float64 {
+	return math.Log2(math.Max(lux, 1) * 100 / incidentLightConstant)
+}
+
+// LogLux returns log10(lux + 1), which follows perceived darkness more closely
+// than lux and is 0 in complete darkness.
+func LogLux(lux float64) float64 {
+	return math.Log10(math.Max(lux, 0) + 1)
+}
+
+// lightness converts relative luminance (0-1) to CIE L* perceptual lightness (0-100).
+func lightness(y float64) float64 {
+	var f float64
+	if y > cieEpsilon {
+		f = math.Cbrt(y)
+	} else {
+		f = y/(3*cieDelta*cieDelta) + 4.0/29.0
+	}
+	return 116*f - 16
 }
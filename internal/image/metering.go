@@ -0,0 +1,66 @@
+package image
+
+import (
+	"fmt"
+	"math"
+)
+
+// Metering modes that control how pixels are weighted when averaging a frame.
+const (
+	MeteringAverage = "average"
+	MeteringCenter  = "center"
+	MeteringSpot    = "spot"
+	MeteringSky     = "sky"
+)
+
+// centerWeightSigma is the spread of the center-weighted falloff, relative to
+// half the frame size. Pixels at the middle of an edge weigh about 14% of the
+// center and the corners about 2%.
+const centerWeightSigma = 0.5
+
+// metering weights pixels by their position in the frame, like the metering
+// modes of a camera.
+type metering struct {
+	mode     string
+	spotSize float64  // diameter of the spot as a percentage of the shorter side
+	sky      *skyMask // sky found in an earlier frame, nil until one is detected
+}
+
+func newMetering(mode string, spotSize float64) (metering, error) {
+	switch mode {
+	case MeteringAverage, MeteringCenter, MeteringSpot, MeteringSky:
+		return metering{mode: mode, spotSize: spotSize}, nil
+	default:
+		return metering{}, fmt.Errorf("unknown metering mode %q", mode)
+	}
+}
+
+// weights returns the weight of every pixel in a frame of the given size,
+// or nil when all pixels weigh the same.
+func (m metering) weights(width, height int) []float64 {
+	if m.mode == MeteringSky && m.sky != nil {
+		return m.sky.weights(width, height)
+	}
+	if m.mode != MeteringCenter && m.mode != MeteringSpot {
+		return nil
+	}
+
+	weights := make([]float64, width*height)
+	cx, cy := float64(width)/2, float64(height)/2
+	radius := math.Max(float64(min(width, height))*m.spotSize/toPercent/2, 1)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// Distance of the pixel center from the frame center
+			dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+			var weight float64
+			if m.mode == MeteringCenter {
+				nx, ny := dx/cx, dy/cy
+				weight = math.Exp(-(nx*nx + ny*ny) / (2 * centerWeightSigma * centerWeightSigma))
+			} else if dx*dx+dy*dy <= radius*radius {
+				weight = 1
+			}
+			weights[y*width+x] = weight
+		}
+	}
+	return weights
+}
@@ -0,0 +1,323 @@
+package image
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// Grids kept for frame-to-frame comparisons
+const (
+	motionGridWidth  = 64
+	motionGridHeight = 48
+)
+
+// metricSet selects the measurements computed in the pass over the pixels.
+type metricSet struct {
+	histogramBuckets int // 0 disables the histogram
+	darkPixels       bool
+	darkThreshold    float64 // luma (0-255) below which a pixel counts as dark
+	stats            bool
+	chroma           bool
+	colorTemperature bool
+	dominantColor    bool
+	lumaSpread       bool
+	lumaPlane        bool
+	hashGrid         bool
+	motionGrid       bool
+	skyGrid          bool
+	linearGrid       bool // uncorrected linear luminance, for reference captures
+}
+
+// measurement holds the raw metrics of a frame before they are turned into a Result.
+type measurement struct {
+	brightness       float64
+	histogram        []int
+	stats            *Stats
+	chroma           float64
+	colorTemperature float64
+	dominantColor    string
+	lumaSpread       float64
+	darkPercent      float64
+	plane            *lumaPlane
+	hashGrid         *lumaPlane
+	motionGrid       *lumaPlane
+	skyGrid          *lumaPlane
+	linearGrid       *lumaPlane
+}
+
+// pixelAccumulator feeds every pixel once to all enabled metrics, so adding
+// metrics doesn't add passes over the image.
+type pixelAccumulator struct {
+	opts       luxOptions
+	set        metricSet
+	width      int
+	height     int
+	included   int // pixels with a weight above 0
+	luminance  *luminanceAccumulator
+	weights    []float64 // metering weight of every pixel, nil when uniform
+	weightSum  float64   // of the pixels added
+	sum        float64   // linear luminance, weighted like the brightness
+	sumSq      float64
+	lumaSum    float64 // gamma-encoded luma
+	lumaSumSq  float64
+	chromaSum  float64
+	darkWeight float64 // of the dark pixels
+	rSum       float64 // linear channels
+	gSum       float64
+	bSum       float64
+	histogram  []int
+	colors     *colorBins
+	plane      *lumaPlane
+	hashGrid   *gridAccumulator
+	motionGrid *gridAccumulator
+	skyGrid    *gridAccumulator
+	linearGrid *gridAccumulator
+}
+
+func newPixelAccumulator(opts luxOptions, set metricSet, width, height int) (*pixelAccumulator, error) {
+	weights, err := combineWeights(opts.metering.weights(width, height), opts.mask)
+	if err != nil {
+		return nil, err
+	}
+	a := &pixelAccumulator{
+		opts:      opts,
+		set:       set,
+		width:     width,
+		height:    height,
+		luminance: newLuminanceAccumulator(opts, width*height),
+		weights:   weights,
+	}
+	if set.histogramBuckets > 0 {
+		a.histogram = make([]int, set.histogramBuckets)
+	}
+	if set.dominantColor {
+		a.colors = &colorBins{}
+	}
+	if set.lumaPlane {
+		a.plane = &lumaPlane{pix: make([]float64, width*height), width: width, height: height}
+	}
+	if set.hashGrid {
+		a.hashGrid = newGridAccumulator(hashWidth, hashHeight, width, height)
+	}
+	if set.motionGrid {
+		a.motionGrid = newGridAccumulator(motionGridWidth, motionGridHeight, width, height)
+	}
+	if set.skyGrid {
+		a.skyGrid = newGridAccumulator(skyGridWidth, skyGridHeight, width, height)
+	}
+	if set.linearGrid {
+		a.linearGrid = newGridAccumulator(referenceGridWidth, referenceGridHeight, width, height)
+	}
+	return a, nil
+}
+
+// add records the pixel at (x, y), relative to the image origin, from its
+// 16-bit channel values.
+func (a *pixelAccumulator) add(x, y int, r, g, b uint32) {
+	rLinear, gLinear, bLinear := a.opts.linearLUT[r], a.opts.linearLUT[g], a.opts.linearLUT[b]
+
+	// Calculate luminance using the configured luma coefficients
+	k := a.opts.coefficients
+	lum := rLinear*k.r + gLinear*k.g + bLinear*k.b
+	if a.linearGrid != nil {
+		a.linearGrid.add(x, y, lum)
+	}
+	if a.opts.flatField != nil {
+		lum = a.opts.flatField.correct(x, y, a.width, a.height, lum)
+	}
+	weight := 1.0
+	if a.weights != nil {
+		weight = a.weights[y*a.width+x]
+	}
+	if weight > 0 {
+		a.luminance.add(lum, weight)
+	}
+	// The stats and dark pixels count the pixels by their weight, so masked
+	// and excluded pixels are left out as they are of the brightness
+	a.weightSum += weight
+	if a.set.stats {
+		a.sum += weight * lum
+		a.sumSq += weight * lum * lum
+	}
+
+	// Gamma-encoded luma (0-255) for perceptual and spatial metrics
+	luma := (float64(r)*k.r + float64(g)*k.g + float64(b)*k.b) / 257
+	if a.set.darkPixels && luma < a.set.darkThreshold {
+		a.darkWeight += weight
+	}
+	// The spatial metrics compare the whole frame position by position
+	if a.plane != nil {
+		a.plane.pix[y*a.width+x] = luma
+	}
+	if a.hashGrid != nil {
+		a.hashGrid.add(x, y, luma)
+	}
+	if a.motionGrid != nil {
+		a.motionGrid.add(x, y, luma)
+	}
+	if a.skyGrid != nil {
+		a.skyGrid.add(x, y, luma)
+	}
+	if weight <= 0 {
+		return
+	}
+
+	// The other metrics of the frame are taken over the same pixels, so
+	// e.g. a masked timestamp overlay doesn't keep a night frame from
+	// reading as blank or in IR mode
+	a.included++
+	if a.set.colorTemperature {
+		a.rSum += rLinear
+		a.gSum += gLinear
+		a.bSum += bLinear
+	}
+	if a.set.chroma {
+		hi := max(int(r), max(int(g), int(b)))
+		lo := min(int(r), min(int(g), int(b)))
+		a.chromaSum += float64(hi-lo) / scale
+	}
+	if a.colors != nil {
+		a.colors.add(r, g, b)
+	}
+	if a.histogram != nil {
+		// A count of the measured pixels, whatever their metering weight
+		buckets := len(a.histogram)
+		bucket := min(int(luma/255*float64(buckets)), buckets-1)
+		a.histogram[bucket]++
+	}
+	if a.set.lumaSpread {
+		a.lumaSum += luma
+		a.lumaSumSq += luma * luma
+	}
+}
+
+// result finalizes the enabled metrics.
+func (a *pixelAccumulator) result() *measurement {
+	m := &measurement{
+		brightness: averageBrightness(a.luminance.result()),
+		histogram:  a.histogram,
+		plane:      a.plane,
+	}
+	n := float64(a.included)
+	if a.set.stats {
+		stats := newStats(a.sum, a.sumSq, a.weightSum, a.opts.scale)
+		m.stats = &stats
+	}
+	if a.set.chroma && n > 0 {
+		m.chroma = a.chromaSum / n
+	}
+	if a.set.colorTemperature {
+		m.colorTemperature = correlatedColorTemperature(a.rSum, a.gSum, a.bSum)
+	}
+	if a.colors != nil {
+		m.dominantColor = a.colors.dominant()
+	}
+	if a.set.lumaSpread {
+		m.lumaSpread = standardDeviation(a.lumaSum, a.lumaSumSq, n)
+	}
+	if a.set.darkPixels {
+		if a.weightSum > 0 {
+			m.darkPercent = a.darkWeight / a.weightSum * toPercent
+		}
+	}
+	if a.hashGrid != nil {
+		m.hashGrid = a.hashGrid.plane()
+	}
+	if a.motionGrid != nil {
+		m.motionGrid = a.motionGrid.plane()
+	}
+	if a.skyGrid != nil {
+		m.skyGrid = a.skyGrid.plane()
+	}
+	if a.linearGrid != nil {
+		m.linearGrid = a.linearGrid.plane()
+	}
+	return m
+}
+
+// measure makes a single pass over the pixels of an image and computes every
+// metric enabled in the set.
+func measure(img image.Image, opts luxOptions, set metricSet) (*measurement, error) {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil, errors.New("image has no pixels to process")
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	acc, err := newPixelAccumulator(opts, set, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	// Optimized paths for common image types read the pixel buffers directly.
+	// Channels are passed on at 16 bits, so high bit depth images keep their
+	// full precision through the lookup table.
+	switch img := img.(type) {
+	case *image.RGBA:
+		for y := 0; y < height; y++ {
+			offset := y * img.Stride
+			for x := 0; x < width; x++ {
+				i := offset + x*4
+				// Widen 8-bit channels to 16 bits for the lookup table
+				acc.add(x, y, uint32(img.Pix[i+0])*257, uint32(img.Pix[i+1])*257, uint32(img.Pix[i+2])*257)
+			}
+		}
+		return acc.result(), nil
+	case *image.YCbCr:
+		// JPEG decodes produce YCbCr, so this is the path most frames take
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				px, py := x+bounds.Min.X, y+bounds.Min.Y
+				yi, ci := img.YOffset(px, py), img.COffset(px, py)
+				r, g, b, _ := color.YCbCr{Y: img.Y[yi], Cb: img.Cb[ci], Cr: img.Cr[ci]}.RGBA()
+				acc.add(x, y, r, g, b)
+			}
+		}
+		return acc.result(), nil
+	case *image.Gray:
+		for y := 0; y < height; y++ {
+			offset := y * img.Stride
+			for x := 0; x < width; x++ {
+				v := uint32(img.Pix[offset+x]) * 257
+				acc.add(x, y, v, v, v)
+			}
+		}
+		return acc.result(), nil
+	case *image.RGBA64:
+		measure16(acc, img.Pix, img.Stride, 8, width, height)
+		return acc.result(), nil
+	case *image.Gray16:
+		measure16(acc, img.Pix, img.Stride, 2, width, height)
+		return acc.result(), nil
+	}
+
+	// Other types, such as the NRGBA64 of 16-bit PNGs with transparency, are
+	// read through At, which premultiplies by alpha at full precision
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(x+bounds.Min.X, y+bounds.Min.Y).RGBA()
+			acc.add(x, y, r, g, b)
+		}
+	}
+	return acc.result(), nil
+}
+
+// measure16 feeds the pixels of a 16-bit image to the accumulator. Channels
+// are stored big-endian, pixelSize bytes per pixel; gray images have a single
+// channel that is used for red, green and blue alike.
+func measure16(acc *pixelAccumulator, pix []uint8, stride, pixelSize, width, height int) {
+	for y := 0; y < height; y++ {
+		offset := y * stride
+		for x := 0; x < width; x++ {
+			i := offset + x*pixelSize
+			r := uint32(pix[i])<<8 | uint32(pix[i+1])
+			if pixelSize == 2 {
+				acc.add(x, y, r, r, r)
+				continue
+			}
+			g := uint32(pix[i+2])<<8 | uint32(pix[i+3])
+			b := uint32(pix[i+4])<<8 | uint32(pix[i+5])
+			acc.add(x, y, r, g, b)
+		}
+	}
+}
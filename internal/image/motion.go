@@ -0,0 +1,21 @@
+package image
+
+import (
+	"math"
+)
+
+// changedRatio returns the fraction of grid cells whose luma differs by more
+// than pixelThreshold between two frames.
+func changedRatio(previous, current *lumaPlane, pixelThreshold float64) float64 {
+	if previous == nil || len(previous.pix) != len(current.pix) || len(current.pix) == 0 {
+		return 0
+	}
+
+	changed := 0
+	for i := range current.pix {
+		if math.Abs(current.pix[i]-previous.pix[i]) > pixelThreshold {
+			changed++
+		}
+	}
+	return float64(changed) / float64(len(current.pix))
+}
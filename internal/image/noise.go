@@ -0,0 +1,25 @@
+package image
+
+import "math"
+
+// calcNoise estimates the standard deviation of sensor noise in luma (0-255)
+// using Immerkær's method: the plane is convolved with a mask that cancels
+// edges and smooth gradients, leaving mostly the high-frequency residual.
+// High values at night mean the lux estimate is less reliable.
+func calcNoise(plane *lumaPlane) float64 {
+	if plane.width < 3 || plane.height < 3 {
+		return 0
+	}
+
+	total := 0.0
+	for y := 1; y < plane.height-1; y++ {
+		for x := 1; x < plane.width-1; x++ {
+			residual := plane.at(x-1, y-1) - 2*plane.at(x, y-1) + plane.at(x+1, y-1) -
+				2*plane.at(x-1, y) + 4*plane.at(x, y) - 2*plane.at(x+1, y) +
+				plane.at(x-1, y+1) - 2*plane.at(x, y+1) + plane.at(x+1, y+1)
+			total += math.Abs(residual)
+		}
+	}
+
+	return math.Sqrt(math.Pi/2) * total / (6 * float64(plane.width-2) * float64(plane.height-2))
+}
@@ -0,0 +1,126 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Flips that can be selected with the IMAGE_FLIP environment variable.
+const (
+	FlipNone       = "none"
+	FlipHorizontal = "horizontal"
+	FlipVertical   = "vertical"
+)
+
+// orientation turns a decoded frame upright by rotating it clockwise and then
+// mirroring it horizontally.
+type orientation struct {
+	rotate int  // degrees clockwise: 0, 90, 180 or 270
+	mirror bool // flip left and right after rotating
+}
+
+// newOrientation returns the configured rotation and flip.
+func newOrientation(rotate int, flip string) (orientation, error) {
+	if rotate%90 != 0 || rotate < 0 || rotate >= 360 {
+		return orientation{}, fmt.Errorf("rotation must be 0, 90, 180 or 270, got %d", rotate)
+	}
+	switch flip {
+	case FlipNone:
+		return orientation{rotate: rotate}, nil
+	case FlipHorizontal:
+		return orientation{rotate: rotate, mirror: true}, nil
+	case FlipVertical:
+		// Flipping top and bottom is a half turn and a horizontal flip
+		return orientation{rotate: (rotate + 180) % 360, mirror: true}, nil
+	default:
+		return orientation{}, fmt.Errorf("unknown flip %q", flip)
+	}
+}
+
+// exifOrientation returns the orientation that displays an image with the
+// given EXIF orientation tag upright. Unknown tags leave the image as is.
+func exifOrientation(tag int) orientation {
+	switch tag {
+	case 2:
+		return orientation{mirror: true}
+	case 3:
+		return orientation{rotate: 180}
+	case 4:
+		return orientation{rotate: 180, mirror: true}
+	case 5:
+		return orientation{rotate: 90, mirror: true}
+	case 6:
+		return orientation{rotate: 90}
+	case 7:
+		return orientation{rotate: 270, mirror: true}
+	case 8:
+		return orientation{rotate: 270}
+	default:
+		return orientation{}
+	}
+}
+
+// then returns the orientation applying o followed by next.
+func (o orientation) then(next orientation) orientation {
+	// Mirroring before a rotation equals rotating the other way and mirroring after
+	rotate := next.rotate
+	if o.mirror {
+		rotate = 360 - rotate
+	}
+	return orientation{rotate: (o.rotate + rotate) % 360, mirror: o.mirror != next.mirror}
+}
+
+// apply returns the image turned by the orientation. Images with 16-bit
+// channels keep their precision, others are converted to 8-bit RGBA.
+func (o orientation) apply(img image.Image) image.Image {
+	if o == (orientation{}) {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := width, height
+	if o.rotate == 90 || o.rotate == 270 {
+		outWidth, outHeight = height, width
+	}
+	rect := image.Rect(0, 0, outWidth, outHeight)
+
+	var out image.Image
+	var set func(x, y int, r, g, b uint32)
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		rgba := image.NewRGBA64(rect)
+		set = func(x, y int, r, g, b uint32) {
+			rgba.SetRGBA64(x, y, color.RGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: 0xffff})
+		}
+		out = rgba
+	default:
+		rgba := image.NewRGBA(rect)
+		set = func(x, y int, r, g, b uint32) {
+			i := rgba.PixOffset(x, y)
+			rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2], rgba.Pix[i+3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), 0xff
+		}
+		out = rgba
+	}
+
+	forEachPixel(img, func(x, y int, r, g, b uint32) {
+		// Where the pixel lands after rotating clockwise
+		var ox, oy int
+		switch o.rotate {
+		case 0:
+			ox, oy = x, y
+		case 90:
+			ox, oy = height-1-y, x
+		case 180:
+			ox, oy = width-1-x, height-1-y
+		case 270:
+			ox, oy = y, width-1-x
+		}
+		if o.mirror {
+			ox = outWidth - 1 - ox
+		}
+		set(ox, oy, r, g, b)
+	})
+	return out
+}
@@ -0,0 +1,52 @@
+package image
+
+// lumaPlane is a grayscale copy of an image, usually holding gamma-encoded
+// luma (0-255), for neighbourhood operations such as edge and noise measurements.
+type lumaPlane struct {
+	pix    []float64
+	width  int
+	height int
+}
+
+// at returns the luma at the given plane coordinates.
+func (p *lumaPlane) at(x, y int) float64 {
+	return p.pix[y*p.width+x]
+}
+
+// gridAccumulator reduces an image to a small plane of average luma, which is
+// cheap to keep between frames and insensitive to pixel-level noise.
+type gridAccumulator struct {
+	cols, rows    int
+	width, height int
+	sums          []float64
+	counts        []int
+}
+
+func newGridAccumulator(cols, rows, width, height int) *gridAccumulator {
+	return &gridAccumulator{
+		cols:   cols,
+		rows:   rows,
+		width:  width,
+		height: height,
+		sums:   make([]float64, cols*rows),
+		counts: make([]int, cols*rows),
+	}
+}
+
+// add records the luma of the pixel at (x, y), relative to the image origin.
+func (g *gridAccumulator) add(x, y int, luma float64) {
+	cell := (y*g.rows/g.height)*g.cols + x*g.cols/g.width
+	g.sums[cell] += luma
+	g.counts[cell]++
+}
+
+// plane returns the average luma of every grid cell.
+func (g *gridAccumulator) plane() *lumaPlane {
+	plane := &lumaPlane{pix: make([]float64, len(g.sums)), width: g.cols, height: g.rows}
+	for i, count := range g.counts {
+		if count > 0 {
+			plane.pix[i] = g.sums[i] / float64(count)
+		}
+	}
+	return plane
+}
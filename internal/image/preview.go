@@ -0,0 +1,33 @@
+package image
+
+import "image"
+
+// previewDim is the brightness pixels left out of the measurement keep in a
+// preview, so the rest of the scene stays recognizable.
+const previewDim = 0.2
+
+// measured is the image a frame was measured on, along with its mask.
+type measured struct {
+	img  image.Image
+	mask []float64 // nil when all pixels count
+}
+
+// preview draws the measured image with the pixels the mask leaves out
+// dimmed in proportion to their weight.
+func (m *measured) preview() image.Image {
+	if m.mask == nil {
+		return m.img
+	}
+	bounds := m.img.Bounds()
+	width := bounds.Dx()
+	out := image.NewRGBA(image.Rect(0, 0, width, bounds.Dy()))
+	forEachPixel(m.img, func(x, y int, r, g, b uint32) {
+		f := previewDim + (1-previewDim)*m.mask[y*width+x]
+		i := out.PixOffset(x, y)
+		out.Pix[i+0] = uint8(float64(r>>8) * f)
+		out.Pix[i+1] = uint8(float64(g>>8) * f)
+		out.Pix[i+2] = uint8(float64(b>>8) * f)
+		out.Pix[i+3] = 0xff
+	})
+	return out
+}
@@ -1,6 +1,7 @@
 package image
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -12,29 +13,138 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"dark-detector/internal/calibration"
 	"dark-detector/internal/config"
 )
 
 const (
-	cropWidth  = 100
-	cropHeight = 100
+	cropWidth    = 100
+	cropHeight   = 100
+	maxImageSize = 64 << 20 // Upper bound on downloaded image size in bytes
 )
 
+// Result holds the measurements taken from a single frame.
+type Result struct {
+	Lux        int
+	Brightness float64 // average linear luminance, 0-1
+	Lightness  float64 // CIE L* perceptual lightness, 0-100
+	Histogram  []int   // nil unless histogram publishing is enabled
+	Stats      *Stats  // nil unless luminance statistics are enabled
+	IRMode     bool    // the camera appears to be in IR/black and white mode
+	// ColorTemperature is the estimated correlated color temperature in kelvin,
+	// 0 unless color temperature estimation is enabled
+	ColorTemperature float64
+	// DominantColor is the most common color as a hex string,
+	// empty unless dominant color detection is enabled
+	DominantColor string
+	// Hash is the perceptual hash of the frame, 0 unless frozen feed detection is enabled
+	Hash uint64
+	// Sharpness is the Laplacian variance of the frame, 0 unless sharpness is enabled
+	Sharpness float64
+	// Blank reports a near-uniform frame (covered lens, error card) whose
+	// reading should not be trusted
+	Blank bool
+	// Motion reports that the scene changed since the previous frame
+	Motion bool
+	// Noise is the estimated sensor noise in luma (0-255), 0 unless noise estimation is enabled
+	Noise float64
+	// DarkPercent is the percentage of the measured pixels below the dark
+	// pixel threshold, 0 unless the dark pixel metric is enabled
+	DarkPercent float64
+	// Regions holds the lux of every configured region by name, nil when none are configured
+	Regions map[string]int
+	// FrameTime is when the frame was taken, from the Last-Modified header of
+	// the snapshot, or when it was downloaded if the camera doesn't send one
+	FrameTime time.Time
+}
+
 type Processor struct {
-	imageURL   string
-	imageCrop  *[]int
-	httpClient *http.Client
-	bufferPool *sync.Pool
+	imageURL       string
+	imageUsername  string // basic auth credentials of the camera, empty when not used
+	imagePassword  string
+	imageCrop      config.Crops
+	imageMask      *imageMask // nil unless a mask file is configured
+	imageExclude   config.Crops
+	downscale      int // factor the cropped image is shrunk by, 1 to keep its size
+	orientation    orientation
+	autoOrient     bool // apply the EXIF orientation tag before the configured one
+	regions        []config.Region
+	luxOptions     luxOptions
+	curve          calibration.Curve
+	schedule       *calibration.Schedule // nil unless a calibration schedule is configured
+	metrics        metricSet
+	exifExposure   bool
+	sharpness      bool
+	noise          bool
+	irThreshold    float64
+	irLuxScale     float64
+	blankThreshold float64
+	motionPixel    float64
+	motionRatio    float64
+	previousGrid   *lumaPlane
+	downloadErrors int                   // failed download attempts since the start
+	decodeErrors   int                   // downloaded frames that could not be decoded
+	lastFrame      atomic.Pointer[frame] // read by the web UI while frames are processed
+	lastMeasured   atomic.Pointer[measured]
+	previewFile    string // written with the measured image every cycle when set
+	httpClient     *http.Client
+	bufferPool     *sync.Pool
 }
 
 // NewProcessor creates a new Processor instance with the provided configuration.
-func NewProcessor(cfg *config.Config) *Processor {
-	return &Processor{
-		imageURL:  cfg.ImageURL,
-		imageCrop: cfg.ImageCrop,
+func NewProcessor(cfg *config.Config) (*Processor, error) {
+	toLinear, err := newTransferFunction(cfg.TransferFunction, cfg.TransferGamma)
+	if err != nil {
+		return nil, err
+	}
+	coefficients, err := newLumaCoefficients(cfg.LumaCoefficients)
+	if err != nil {
+		return nil, err
+	}
+	metering, err := newMetering(cfg.MeteringMode, cfg.MeteringSpotSize)
+	if err != nil {
+		return nil, err
+	}
+	orientation, err := newOrientation(cfg.ImageRotation, cfg.ImageFlip)
+	if err != nil {
+		return nil, err
+	}
+	var calibrationFile *calibration.File
+	if cfg.CalibrationFile != "" {
+		if calibrationFile, err = calibration.LoadFile(cfg.CalibrationFile); err != nil {
+			return nil, err
+		}
+	}
+	curve, err := calibration.New(cfg, calibrationFile)
+	if err != nil {
+		return nil, err
+	}
+	var mask *imageMask
+	if cfg.ImageMask != "" {
+		if mask, err = loadImageMask(cfg.ImageMask); err != nil {
+			return nil, err
+		}
+	}
+	var correction *flatField
+	if calibrationFile != nil && calibrationFile.Reference != nil {
+		if correction, err = newFlatField(calibrationFile.Reference); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &Processor{
+		imageURL:      cfg.ImageURL,
+		imageUsername: cfg.ImageUsername,
+		imagePassword: cfg.ImagePassword,
+		imageCrop:     cfg.ImageCrop,
+		imageMask:     mask,
+		regions:       cfg.Regions,
+		curve:         curve,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 			Transport: &http.Transport{
@@ -48,37 +158,330 @@ func NewProcessor(cfg *config.Config) *Processor {
 		},
 		bufferPool: &sync.Pool{
 			New: func() interface{} {
-				return make([]float64, 0, 1024) // Initial capacity for intermediate calculations
+				return make([]sample, 0, 1024) // Initial capacity for intermediate calculations
 			},
 		},
 	}
+	p.luxOptions = luxOptions{
+		scale:         cfg.LuxScale,
+		linearLUT:     newLinearLUT(toLinear),
+		coefficients:  coefficients,
+		trimPercent:   cfg.LuxTrimPercent,
+		clipThreshold: cfg.LuxClipThreshold,
+		metering:      metering,
+		flatField:     correction,
+		bufferPool:    p.bufferPool,
+	}
+	p.metrics = metricSet{
+		stats:            cfg.LuminanceStatsEnabled,
+		chroma:           cfg.IRModeEnabled,
+		colorTemperature: cfg.ColorTemperatureEnabled,
+		dominantColor:    cfg.DominantColorEnabled,
+		lumaSpread:       cfg.BlankFrameThreshold > 0,
+		lumaPlane:        cfg.SharpnessEnabled || cfg.NoiseEnabled,
+		hashGrid:         cfg.FrozenDetectionEnabled,
+		motionGrid:       cfg.MotionEnabled,
+		skyGrid:          metering.mode == MeteringSky,
+		darkPixels:       cfg.DarkPixelsEnabled,
+		darkThreshold:    cfg.DarkPixelThreshold,
+	}
+	if cfg.HistogramEnabled {
+		p.metrics.histogramBuckets = cfg.HistogramBuckets
+	}
+	if len(cfg.CalibrationSchedule) > 0 {
+		p.schedule = calibration.NewSchedule(cfg.CalibrationSchedule)
+	}
+	p.imageExclude = cfg.ImageExclude
+	p.downscale = cfg.Downscale
+	p.previewFile = cfg.PreviewFile
+	p.orientation = orientation
+	p.autoOrient = cfg.EXIFOrientationEnabled
+	p.exifExposure = cfg.EXIFExposureEnabled
+	p.sharpness = cfg.SharpnessEnabled
+	p.noise = cfg.NoiseEnabled
+	p.irThreshold = cfg.IRChromaThreshold
+	p.irLuxScale = cfg.IRLuxScale
+	p.blankThreshold = cfg.BlankFrameThreshold
+	p.motionPixel = cfg.MotionPixelThreshold
+	p.motionRatio = cfg.MotionRatioThreshold
+	return p, nil
 }
 
 // Process processes the image from the URL and calculates its luminance in lux.
-func (p *Processor) Process(ctx context.Context) (int, error) {
+func (p *Processor) Process(ctx context.Context) (*Result, error) {
 	if ctx == nil {
-		return 0, fmt.Errorf("nil context provided")
+		return nil, fmt.Errorf("nil context provided")
 	}
 
 	if _, err := url.Parse(p.imageURL); err != nil {
-		return 0, fmt.Errorf("invalid image URL: %w", err)
+		return nil, fmt.Errorf("invalid image URL: %w", err)
+	}
+
+	frame, err := p.downloadImage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading image: %w", err)
+	}
+	return p.process(frame)
+}
+
+// ProcessImage calculates the luminance of an image received rather than
+// downloaded, such as a camera snapshot published over MQTT.
+func (p *Processor) ProcessImage(data []byte) (*Result, error) {
+	frame, err := decodeFrame(data, time.Now())
+	if err != nil {
+		p.decodeErrors++
+		return nil, err
 	}
+	return p.process(frame)
+}
 
-	img, err := p.downloadImage(ctx)
+// process measures a decoded frame.
+func (p *Processor) process(frame *frame) (*Result, error) {
+	img, mask, err := p.prepareFrame(frame)
 	if err != nil {
-		return 0, fmt.Errorf("error downloading image: %w", err)
+		return nil, err
 	}
 
-	luminance, err := calcLux(img)
+	p.lastMeasured.Store(&measured{img: img, mask: mask})
+	if p.previewFile != "" {
+		if err := saveToJpgFile(p.Preview(), p.previewFile); err != nil {
+			log.Printf("Failed to write preview: %v", err)
+		}
+	}
+
+	opts := p.luxOptions
+	opts.mask = mask
+	m, err := measure(img, opts, p.metrics)
 	if err != nil {
-		return 0, fmt.Errorf("error processing image: %w", err)
+		return nil, fmt.Errorf("error processing image: %w", err)
+	}
+	if m.skyGrid != nil {
+		// Meter the next frames with the sky found in this one, keeping the
+		// last detection when the frame is too dark to find the sky
+		if sky := detectSky(m.skyGrid); sky != nil {
+			p.luxOptions.metering.sky = sky
+		}
 	}
 
-	return luminance, nil
+	// Weighted regions replace the crop in the combined brightness
+	brightness := m.brightness
+	var regions map[string]float64
+	if len(p.regions) > 0 {
+		regions = make(map[string]float64, len(p.regions))
+		var weighted, totalWeight float64
+		for _, region := range p.regions {
+			regionBrightness, err := p.measureRegion(frame.img, region.Crop)
+			if err != nil {
+				return nil, fmt.Errorf("error processing region %q: %w", region.Name, err)
+			}
+			regions[region.Name] = regionBrightness
+			weighted += region.Weight * regionBrightness
+			totalWeight += region.Weight
+		}
+		if totalWeight > 0 {
+			brightness = weighted / totalWeight
+		}
+	}
+
+	result := &Result{
+		Brightness:       brightness,
+		Lightness:        lightness(brightness),
+		Histogram:        m.histogram,
+		Stats:            m.stats,
+		ColorTemperature: m.colorTemperature,
+		DominantColor:    m.dominantColor,
+		DarkPercent:      m.darkPercent,
+		FrameTime:        frame.time,
+	}
+	curve := p.curve
+	if p.metrics.chroma {
+		result.IRMode = m.chroma < p.irThreshold
+		if result.IRMode && p.irLuxScale > 0 {
+			curve = calibration.Linear{Scale: p.irLuxScale}
+		}
+	}
+	if p.schedule != nil {
+		curve = calibration.Scaled{Curve: curve, Factor: p.schedule.Factor(time.Now())}
+	}
+	result.Lux = scaleLux(brightness, curve)
+	if p.exifExposure && frame.exif.hasExposure() {
+		result.Lux = int(frame.exif.exposureLux(brightness))
+	}
+	if m.hashGrid != nil {
+		result.Hash = perceptualHash(m.hashGrid)
+	}
+	if p.sharpness {
+		result.Sharpness = calcSharpness(m.plane)
+	}
+	if p.noise {
+		result.Noise = calcNoise(m.plane)
+	}
+	if p.metrics.lumaSpread {
+		result.Blank = m.lumaSpread < p.blankThreshold
+	}
+	if m.motionGrid != nil {
+		result.Motion = changedRatio(p.previousGrid, m.motionGrid, p.motionPixel) > p.motionRatio
+		p.previousGrid = m.motionGrid
+	}
+	if regions != nil {
+		result.Regions = make(map[string]int, len(regions))
+		for name, regionBrightness := range regions {
+			result.Regions[name] = scaleLux(regionBrightness, curve)
+		}
+	}
+
+	return result, nil
+}
+
+// Curve returns the calibration curve used for frames.
+func (p *Processor) Curve() calibration.Curve {
+	return p.curve
+}
+
+// prepareFrame returns the cropped image of a frame to measure and the mask
+// of the pixels to meter, nil when all of them count.
+func (p *Processor) prepareFrame(frame *frame) (image.Image, []float64, error) {
+	// Turn the frame upright first, so crops match what the camera shows
+	orientation := p.orientation
+	if p.autoOrient && frame.exif != nil {
+		orientation = exifOrientation(frame.exif.orientation).then(orientation)
+	}
+	frame.img = orientation.apply(frame.img)
+	p.lastFrame.Store(frame)
+	img, mask, err := p.maskFrame(frame.img, p.imageCrop)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.downscale > 1 {
+		img, mask = downscale(img, mask, p.downscale, p.luxOptions.linearLUT)
+	}
+	return img, mask, nil
 }
 
-// downloadImage downloads the image from the URL and decodes it.
-func (p *Processor) downloadImage(ctx context.Context) (image.Image, error) {
+// maskFrame crops an upright frame to crops and returns the cropped image
+// with the weights of its pixels after the image mask and exclusions, nil
+// when all of them count.
+func (p *Processor) maskFrame(img image.Image, crops config.Crops) (image.Image, []float64, error) {
+	cropped, mask, err := cropFrame(img, crops)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to crop image: %w", err)
+	}
+	if p.imageMask != nil {
+		if mask, err = combineWeights(mask, p.imageMask.weights(img.Bounds(), cropped.Bounds())); err != nil {
+			return nil, nil, fmt.Errorf("failed to apply image mask: %w", err)
+		}
+	}
+	if p.imageExclude != nil {
+		exclude, err := excludeWeights(cropped.Bounds(), img.Bounds(), p.imageExclude)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to exclude image regions: %w", err)
+		}
+		if mask, err = combineWeights(mask, exclude); err != nil {
+			return nil, nil, fmt.Errorf("failed to exclude image regions: %w", err)
+		}
+	}
+	return cropped, mask, nil
+}
+
+// LastFrame returns the latest downloaded frame before cropping, nil before
+// the first one. It is safe to call while frames are processed.
+func (p *Processor) LastFrame() image.Image {
+	if frame := p.lastFrame.Load(); frame != nil {
+		return frame.img
+	}
+	return nil
+}
+
+// Preview returns the image the latest frame was measured on, after
+// cropping and downscaling, with the pixels left out by masks and exclusions
+// dimmed. It is nil before the first frame and safe to call while frames are
+// processed.
+func (p *Processor) Preview() image.Image {
+	if m := p.lastMeasured.Load(); m != nil {
+		return m.preview()
+	}
+	return nil
+}
+
+// DownloadErrors returns the number of failed download attempts since the
+// start, including those that succeeded on a retry.
+func (p *Processor) DownloadErrors() int {
+	return p.downloadErrors
+}
+
+// DecodeErrors returns the number of downloaded frames that could not be
+// decoded since the start, e.g. truncated or not an image at all.
+func (p *Processor) DecodeErrors() int {
+	return p.decodeErrors
+}
+
+// Crop returns the crops applied to frames, nil when frames are not cropped.
+func (p *Processor) Crop() config.Crops {
+	return p.imageCrop
+}
+
+// SetCrop replaces the crops applied to subsequent frames. An empty list
+// measures the whole frame.
+func (p *Processor) SetCrop(crops config.Crops) {
+	p.imageCrop = crops
+	// The sky found in the previous crop doesn't line up with the new one
+	p.luxOptions.metering.sky = nil
+}
+
+// CheckCrop reports why crops would leave no pixels of the latest frame to
+// measure, so a crop that fails every reading can be refused before it is
+// applied. It returns nil before the first frame.
+func (p *Processor) CheckCrop(crops config.Crops) error {
+	frame := p.LastFrame()
+	if frame == nil {
+		return nil
+	}
+	// As in prepareFrame, pixels masked or excluded don't count either
+	_, mask, err := p.maskFrame(frame, crops)
+	if err != nil {
+		return err
+	}
+	if mask != nil && !slices.ContainsFunc(mask, func(w float64) bool { return w > 0 }) {
+		return fmt.Errorf("crop has no pixels left to measure in the %dx%d frame", frame.Bounds().Dx(), frame.Bounds().Dy())
+	}
+	return nil
+}
+
+// SetCurve replaces the calibration curve used for subsequent frames.
+func (p *Processor) SetCurve(curve calibration.Curve) {
+	p.curve = curve
+}
+
+// measureRegion returns the average brightness of a rectangle or polygon of
+// the full frame.
+func (p *Processor) measureRegion(img image.Image, crop config.Crop) (float64, error) {
+	region, mask, err := cropFrame(img, config.Crops{crop})
+	if err != nil {
+		return 0, err
+	}
+	// The sky mask covers the whole frame, so it doesn't apply to a region
+	opts := p.luxOptions
+	opts.metering.sky = nil
+	opts.mask = mask
+	m, err := measure(region, opts, metricSet{})
+	if err != nil {
+		return 0, err
+	}
+	return m.brightness, nil
+}
+
+// frame is a decoded image along with the metadata read from the download.
+type frame struct {
+	img  image.Image
+	exif *exifData // nil when the image carries no EXIF metadata
+	time time.Time
+}
+
+// downloadImage downloads the full image from the URL and decodes it.
+func (p *Processor) downloadImage(ctx context.Context) (*frame, error) {
+	if p.imageURL == "" {
+		return nil, fmt.Errorf("no IMAGE_URL to download frames from")
+	}
 	maxRetries := 3
 	var lastErr error
 
@@ -98,80 +501,157 @@ func (p *Processor) downloadImage(ctx context.Context) (image.Image, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
+		if p.imageUsername != "" || p.imagePassword != "" {
+			req.SetBasicAuth(p.imageUsername, p.imagePassword)
+		}
 
 		resp, err := p.httpClient.Do(req)
 		if err != nil {
 			lastErr = fmt.Errorf("failed to download image: %w", err)
+			p.downloadErrors++
 			continue
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
 			lastErr = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+			p.downloadErrors++
 			continue
 		}
 
-		var reader io.Reader = resp.Body
-		if resp.ContentLength > 0 {
-			reader = io.LimitReader(resp.Body, resp.ContentLength)
+		limit := int64(maxImageSize)
+		if resp.ContentLength > 0 && resp.ContentLength < limit {
+			limit = resp.ContentLength
 		}
-
-		img, _, err := image.Decode(reader)
+		data, err := io.ReadAll(io.LimitReader(resp.Body, limit))
 		if err != nil {
-			lastErr = fmt.Errorf("failed to decode image: %w", err)
+			lastErr = fmt.Errorf("failed to read image: %w", err)
+			p.downloadErrors++
 			continue
 		}
 
-		if p.imageCrop != nil {
-			croppedImg, err := cropImage(img, *p.imageCrop)
-			if err != nil {
-				return nil, fmt.Errorf("failed to crop image: %w", err)
-			}
-			img = croppedImg
+		// Cameras with a wrong clock can't send frames from the future
+		frameTime := time.Now()
+		if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && modified.Before(frameTime) {
+			frameTime = modified
 		}
 
-		return img, nil
+		frame, err := decodeFrame(data, frameTime)
+		if err != nil {
+			lastErr = err
+			p.decodeErrors++
+			continue
+		}
+		return frame, nil
 	}
 
 	return nil, fmt.Errorf("failed after %d attempts: %w", maxRetries, lastErr)
 }
 
-// cropImage crops the image based on the provided dimensions.
-// if only 2 crop dimensions are not provided, it defaults to cropWidth and cropHeight.
-func cropImage(img image.Image, imageCrop []int) (image.Image, error) {
+// decodeFrame decodes the image data of a frame taken at frameTime.
+func decodeFrame(data []byte, frameTime time.Time) (*frame, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	exif, err := parseExif(data)
+	if err != nil {
+		log.Printf("Ignoring unreadable EXIF metadata: %v", err)
+	}
+	return &frame{img: img, exif: exif, time: frameTime}, nil
+}
+
+// cropImage crops the image based on the provided dimensions, resolving
+// percentages and anchors against the size of the image.
+func cropImage(img image.Image, imageCrop config.Crop) (image.Image, error) {
 	if img == nil {
 		return nil, errors.New("image is nil")
 	}
+	rect, err := cropRect(img.Bounds(), imageCrop)
+	if err != nil {
+		return nil, err
+	}
+	return subImage(img, rect), nil
+}
+
+// errCropOutside is returned for a crop that lies entirely beyond the frame.
+var errCropOutside = errors.New("crop is outside the frame")
 
-	bounds := img.Bounds()
+// cropRect returns the rectangle of an image with the given bounds that the
+// crop selects, clipped to the image.
+// if only 2 crop dimensions are not provided, it defaults to cropWidth and cropHeight.
+func cropRect(bounds image.Rectangle, imageCrop config.Crop) (image.Rectangle, error) {
 	if bounds.Empty() {
-		return nil, errors.New("image has no pixels to crop")
+		return image.Rectangle{}, errors.New("image has no pixels to crop")
 	}
-
-	if imageCrop == nil || (len(imageCrop) != 2 && len(imageCrop) != 4) {
-		return nil, fmt.Errorf("invalid crop dimensions: %v", imageCrop)
+	if imageCrop.Polygon != nil {
+		return clipCrop(polygonBounds(polygonVertices(imageCrop.Polygon, bounds)), bounds, imageCrop)
 	}
 
 	var width, height int
-	if len(imageCrop) == 4 {
-		width = imageCrop[2]
-		height = imageCrop[3]
+	if imageCrop.HasSize() {
+		width = imageCrop.Width.Resolve(bounds.Dx())
+		height = imageCrop.Height.Resolve(bounds.Dy())
 	} else {
 		width = cropWidth
 		height = cropHeight
 	}
-	imgBounds := img.Bounds()
-	x1 := max(imageCrop[0], imgBounds.Min.X)
-	y1 := max(imageCrop[1], imgBounds.Min.Y)
-	x2 := min(x1+width, imgBounds.Max.X)
-	y2 := min(y1+height, imgBounds.Max.Y)
+	if width <= 0 || height <= 0 {
+		return image.Rectangle{}, fmt.Errorf("invalid crop dimensions: %v", imageCrop)
+	}
+	x, y := cropOrigin(imageCrop, bounds, width, height)
+	return clipCrop(image.Rect(x, y, x+width, y+height), bounds, imageCrop)
+}
+
+// clipCrop returns the part of rect within the bounds of the image, or
+// errCropOutside when none of it is.
+func clipCrop(rect, bounds image.Rectangle, imageCrop config.Crop) (image.Rectangle, error) {
+	rect = rect.Intersect(bounds)
+	if rect.Empty() {
+		return image.Rectangle{}, fmt.Errorf("%w: %v in %dx%d", errCropOutside, imageCrop, bounds.Dx(), bounds.Dy())
+	}
+	return rect, nil
+}
 
-	newBounds := image.Rect(x1, y1, x2, y2)
-	croppedImg := img.(interface {
+// subImage returns the part of the image within the rectangle.
+func subImage(img image.Image, rect image.Rectangle) image.Image {
+	return img.(interface {
 		SubImage(r image.Rectangle) image.Image
-	}).SubImage(newBounds)
+	}).SubImage(rect)
+}
+
+// cropOrigin returns the top-left corner of a crop of the given size. Pixel
+// coordinates are absolute, percentages are relative to the origin of the
+// image and anchors place the crop against its edges or center.
+func cropOrigin(crop config.Crop, bounds image.Rectangle, width, height int) (int, int) {
+	if crop.Anchor == "" {
+		return cropOffset(crop.X, bounds.Min.X, bounds.Dx()), cropOffset(crop.Y, bounds.Min.Y, bounds.Dy())
+	}
+
+	x, y := bounds.Min.X, bounds.Min.Y
+	switch crop.Anchor {
+	case config.AnchorTop, config.AnchorCenter, config.AnchorBottom:
+		x += (bounds.Dx() - width) / 2
+	case config.AnchorTopRight, config.AnchorRight, config.AnchorBottomRight:
+		x = bounds.Max.X - width
+	}
+	switch crop.Anchor {
+	case config.AnchorLeft, config.AnchorCenter, config.AnchorRight:
+		y += (bounds.Dy() - height) / 2
+	case config.AnchorBottomLeft, config.AnchorBottom, config.AnchorBottomRight:
+		y = bounds.Max.Y - height
+	}
+	return x, y
+}
 
-	return croppedImg, nil
+// cropOffset returns the coordinate of a crop origin. Pixel coordinates are
+// absolute, percentages are relative to the origin of the image.
+func cropOffset(v config.CropValue, origin, size int) int {
+	if v.Percent {
+		return origin + v.Resolve(size)
+	}
+	return v.Resolve(size)
 }
 
 func min(a, b int) int {
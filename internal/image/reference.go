@@ -0,0 +1,87 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"dark-detector/internal/calibration"
+)
+
+// Resolution of the black and white reference grids, fine enough to follow
+// lens vignetting
+const (
+	referenceGridWidth  = 32
+	referenceGridHeight = 24
+)
+
+// flatField corrects the linear luminance of pixels for the sensor's black
+// level and for vignetting, using references captured from a covered lens and
+// an evenly lit white target.
+type flatField struct {
+	cols, rows int
+	black      []float64
+	gain       []float64
+}
+
+func newFlatField(ref *calibration.Reference) (*flatField, error) {
+	n := ref.Width * ref.Height
+	if n <= 0 || (len(ref.Black) != 0 && len(ref.Black) != n) || (len(ref.White) != 0 && len(ref.White) != n) {
+		return nil, fmt.Errorf("calibration reference grids don't match their %dx%d size", ref.Width, ref.Height)
+	}
+
+	f := &flatField{cols: ref.Width, rows: ref.Height, black: make([]float64, n), gain: make([]float64, n)}
+	copy(f.black, ref.Black)
+	for i := range f.gain {
+		f.gain[i] = 1
+	}
+	if len(ref.White) == 0 {
+		return f, nil
+	}
+
+	// Scale every cell so an even white target reads as its average
+	mean := 0.0
+	for i, white := range ref.White {
+		mean += white - f.black[i]
+	}
+	mean /= float64(n)
+	for i, white := range ref.White {
+		if response := white - f.black[i]; response > 0 {
+			f.gain[i] = mean / response
+		}
+	}
+	return f, nil
+}
+
+// correct returns the corrected luminance of the pixel at (x, y) in a frame
+// of the given size.
+func (f *flatField) correct(x, y, width, height int, lum float64) float64 {
+	cell := (y*f.rows/height)*f.cols + x*f.cols/width
+	return math.Max(lum-f.black[cell], 0) * f.gain[cell]
+}
+
+// CaptureReference measures the uncorrected linear luminance of the next
+// frame as a reference grid.
+func (p *Processor) CaptureReference(ctx context.Context) ([]float64, error) {
+	frame, err := p.downloadImage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading image: %w", err)
+	}
+	img, _, err := p.prepareFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := p.luxOptions
+	opts.flatField = nil
+	m, err := measure(img, opts, metricSet{linearGrid: true})
+	if err != nil {
+		return nil, fmt.Errorf("error processing image: %w", err)
+	}
+	return m.linearGrid.pix, nil
+}
+
+// ReferenceSize returns the width and height of reference grids.
+func ReferenceSize() (int, int) {
+	return referenceGridWidth, referenceGridHeight
+}
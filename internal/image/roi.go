@@ -0,0 +1,210 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"sort"
+
+	"dark-detector/internal/config"
+)
+
+// cropFrame crops the frame to the configured crops. Several crops or a
+// polygon are cut out as the rectangle covering all of them, and the returned
+// mask then holds 1 for the pixels of the cropped image within a crop and 0
+// for the others. The mask is nil when every pixel counts.
+func cropFrame(img image.Image, crops config.Crops) (image.Image, []float64, error) {
+	if len(crops) == 0 {
+		return img, nil, nil
+	}
+	if len(crops) == 1 && crops[0].Polygon == nil {
+		cropped, err := cropImage(img, crops[0])
+		return cropped, nil, err
+	}
+
+	// The rectangles are clipped to the frame, so the mask covers the same
+	// pixels as the cropped image
+	var union image.Rectangle
+	for _, crop := range crops {
+		rect, err := cropRect(img.Bounds(), crop)
+		if err != nil {
+			return nil, nil, err
+		}
+		union = union.Union(rect)
+	}
+
+	mask := make([]float64, union.Dx()*union.Dy())
+	if err := fillCrops(mask, union, img.Bounds(), crops, 1); err != nil {
+		return nil, nil, err
+	}
+	return subImage(img, union), mask, nil
+}
+
+// excludeWeights returns the weights of the pixels of rect, a part of a frame
+// with the given bounds, that are 0 within the excluded crops and 1 elsewhere.
+func excludeWeights(rect, frame image.Rectangle, exclude config.Crops) ([]float64, error) {
+	weights := make([]float64, rect.Dx()*rect.Dy())
+	for i := range weights {
+		weights[i] = 1
+	}
+	if err := fillCrops(weights, rect, frame, exclude, 0); err != nil {
+		return nil, err
+	}
+	return weights, nil
+}
+
+// fillCrops sets every pixel of the mask, which covers rect of a frame with
+// the given bounds, that lies within one of the crops to value.
+func fillCrops(mask []float64, rect, frame image.Rectangle, crops config.Crops, value float64) error {
+	for _, crop := range crops {
+		if crop.Polygon != nil {
+			fillPolygon(mask, rect, polygonVertices(crop.Polygon, frame), value)
+			continue
+		}
+		cropped, err := cropRect(frame, crop)
+		if errors.Is(err, errCropOutside) {
+			// Nothing of the frame to fill, e.g. an exclusion meant for a larger stream
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		cropped = cropped.Intersect(rect)
+		for y := cropped.Min.Y; y < cropped.Max.Y; y++ {
+			for x := cropped.Min.X; x < cropped.Max.X; x++ {
+				mask[(y-rect.Min.Y)*rect.Dx()+x-rect.Min.X] = value
+			}
+		}
+	}
+	return nil
+}
+
+// point is a vertex of a polygon in image coordinates.
+type point struct {
+	x, y float64
+}
+
+// polygonVertices resolves the vertices of a polygon crop in an image with
+// the given bounds.
+func polygonVertices(polygon []config.CropPoint, bounds image.Rectangle) []point {
+	vertices := make([]point, len(polygon))
+	for i, v := range polygon {
+		vertices[i] = point{
+			x: float64(cropOffset(v.X, bounds.Min.X, bounds.Dx())),
+			y: float64(cropOffset(v.Y, bounds.Min.Y, bounds.Dy())),
+		}
+	}
+	return vertices
+}
+
+// polygonBounds returns the smallest rectangle of pixels covering the polygon.
+func polygonBounds(vertices []point) image.Rectangle {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, v := range vertices {
+		minX, maxX = math.Min(minX, v.x), math.Max(maxX, v.x)
+		minY, maxY = math.Min(minY, v.y), math.Max(maxY, v.y)
+	}
+	return image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY)))
+}
+
+// fillPolygon sets the mask to value for every pixel whose center lies within
+// the polygon, using the even-odd rule. The mask covers the rectangle rect.
+func fillPolygon(mask []float64, rect image.Rectangle, vertices []point, value float64) {
+	width := rect.Dx()
+	crossings := make([]float64, 0, len(vertices))
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		// Find where the edges cross the row through the pixel centers
+		cy := float64(y) + 0.5
+		crossings = crossings[:0]
+		for i, a := range vertices {
+			b := vertices[(i+1)%len(vertices)]
+			if (a.y <= cy) != (b.y <= cy) {
+				crossings = append(crossings, a.x+(cy-a.y)/(b.y-a.y)*(b.x-a.x))
+			}
+		}
+		sort.Float64s(crossings)
+
+		for i := 0; i+1 < len(crossings); i += 2 {
+			// Pixels whose centers lie between a pair of crossings are inside
+			x1 := max(int(math.Ceil(crossings[i]-0.5)), rect.Min.X)
+			x2 := min(int(math.Ceil(crossings[i+1]-0.5)), rect.Max.X)
+			for x := x1; x < x2; x++ {
+				mask[(y-rect.Min.Y)*width+x-rect.Min.X] = value
+			}
+		}
+	}
+}
+
+// imageMask weights the pixels of the frame by a grayscale image painted by
+// the user, black excluding a pixel and white including it fully. It is
+// scaled to the size of the frame.
+type imageMask struct {
+	width, height int
+	pix           []float64
+}
+
+// loadImageMask reads a mask from a PNG or JPEG file. Colors are converted to
+// gray and transparent pixels are excluded.
+func loadImageMask(path string) (*imageMask, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image mask: %w", err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image mask: %w", err)
+	}
+
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil, fmt.Errorf("image mask has no pixels")
+	}
+	m := &imageMask{width: bounds.Dx(), height: bounds.Dy(), pix: make([]float64, bounds.Dx()*bounds.Dy())}
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			gray := color.Gray16Model.Convert(img.At(x+bounds.Min.X, y+bounds.Min.Y)).(color.Gray16)
+			m.pix[y*m.width+x] = float64(gray.Y) / scale
+		}
+	}
+	return m, nil
+}
+
+// weights returns the mask weight of every pixel of rect, a part of a frame
+// with the given bounds.
+func (m *imageMask) weights(frame, rect image.Rectangle) []float64 {
+	width, height := rect.Dx(), rect.Dy()
+	weights := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		// Nearest mask pixel for the frame pixel
+		my := (rect.Min.Y + y - frame.Min.Y) * m.height / frame.Dy()
+		for x := 0; x < width; x++ {
+			mx := (rect.Min.X + x - frame.Min.X) * m.width / frame.Dx()
+			weights[y*width+x] = m.pix[my*m.width+mx]
+		}
+	}
+	return weights
+}
+
+// combineWeights multiplies two sets of pixel weights, either of which may
+// be nil when all pixels weigh the same. Both must cover the same pixels.
+func combineWeights(a, b []float64) ([]float64, error) {
+	if a == nil {
+		return b, nil
+	}
+	if b == nil {
+		return a, nil
+	}
+	if len(a) != len(b) {
+		return nil, fmt.Errorf("pixel weights of %d and %d pixels don't line up", len(a), len(b))
+	}
+	combined := make([]float64, len(a))
+	for i := range a {
+		combined[i] = a[i] * b[i]
+	}
+	return combined, nil
+}
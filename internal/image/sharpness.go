@@ -0,0 +1,24 @@
+package image
+
+// calcSharpness measures image sharpness as the variance of the Laplacian of
+// the luma plane. Fog, dew on the lens or a defocused camera blur edges and
+// drive the value towards zero.
+func calcSharpness(plane *lumaPlane) float64 {
+	if plane.width < 3 || plane.height < 3 {
+		return 0
+	}
+
+	sum, sumSq := 0.0, 0.0
+	n := 0
+	for y := 1; y < plane.height-1; y++ {
+		for x := 1; x < plane.width-1; x++ {
+			laplacian := 4*plane.at(x, y) - plane.at(x-1, y) - plane.at(x+1, y) - plane.at(x, y-1) - plane.at(x, y+1)
+			sum += laplacian
+			sumSq += laplacian * laplacian
+			n++
+		}
+	}
+
+	mean := sum / float64(n)
+	return sumSq/float64(n) - mean*mean
+}
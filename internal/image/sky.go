@@ -0,0 +1,68 @@
+package image
+
+import "math"
+
+// Sky detection parameters
+const (
+	skyGridWidth     = 32
+	skyGridHeight    = 24
+	skyEdgeThreshold = 12   // luma step (0-255) between grid rows that ends the sky
+	skyMinLuma       = 60   // average luma (0-255) needed to trust a detection
+	skyMinCoverage   = 0.05 // fraction of the frame the sky must cover
+)
+
+// skyMask marks the grid cells of a frame that show sky.
+type skyMask struct {
+	cols, rows int
+	sky        []bool
+}
+
+// detectSky finds the sky in a grid of average luma. Outdoors the sky is the
+// bright, smooth area at the top of the frame, so every column is followed
+// down from the top until the first strong edge, such as a roof line or
+// horizon. It returns nil when the frame is too dark to tell or shows no sky.
+func detectSky(grid *lumaPlane) *skyMask {
+	mean := 0.0
+	for _, luma := range grid.pix {
+		mean += luma
+	}
+	mean /= float64(len(grid.pix))
+	if mean < skyMinLuma {
+		return nil
+	}
+
+	mask := &skyMask{cols: grid.width, rows: grid.height, sky: make([]bool, len(grid.pix))}
+	cells := 0
+	for x := 0; x < grid.width; x++ {
+		// The sky is brighter than the frame on average
+		if grid.at(x, 0) < mean {
+			continue
+		}
+		for y := 0; y < grid.height; y++ {
+			if y > 0 && math.Abs(grid.at(x, y)-grid.at(x, y-1)) > skyEdgeThreshold {
+				break
+			}
+			mask.sky[y*grid.width+x] = true
+			cells++
+		}
+	}
+	if float64(cells) < skyMinCoverage*float64(len(mask.sky)) {
+		return nil
+	}
+	return mask
+}
+
+// weights returns 1 for every pixel of a frame of the given size that falls
+// in a sky cell and 0 otherwise.
+func (s *skyMask) weights(width, height int) []float64 {
+	weights := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		row := y * s.rows / height * s.cols
+		for x := 0; x < width; x++ {
+			if s.sky[row+x*s.cols/width] {
+				weights[y*width+x] = 1
+			}
+		}
+	}
+	return weights
+}
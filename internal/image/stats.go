@@ -0,0 +1,38 @@
+package image
+
+import (
+	"math"
+)
+
+// Stats holds the spread of luminance across a frame.
+// A dark scene still shows some structure, while a covered or obstructed lens
+// produces a frame with almost no spread at all.
+type Stats struct {
+	StdDev   float64 // standard deviation of luminance, in lux
+	Contrast float64 // RMS contrast, the standard deviation relative to the mean
+}
+
+// newStats derives the luminance statistics from the sums of linear luminance
+// and its square over n pixels.
+func newStats(sum, sumSq, n, luxScale float64) Stats {
+	if n == 0 {
+		return Stats{}
+	}
+
+	mean := sum / n
+	stddev := standardDeviation(sum, sumSq, n)
+	stats := Stats{StdDev: stddev * luxScale}
+	if mean > 0 {
+		stats.Contrast = stddev / mean
+	}
+	return stats
+}
+
+// standardDeviation computes the population standard deviation from running sums.
+func standardDeviation(sum, sumSq, n float64) float64 {
+	if n == 0 {
+		return 0
+	}
+	mean := sum / n
+	return math.Sqrt(math.Max(sumSq/n-mean*mean, 0))
+}
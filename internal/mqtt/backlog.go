@@ -0,0 +1,147 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errOffline is returned by publish while the broker is unreachable. With
+// offline buffering, lux readings are buffered instead.
+var errOffline = errors.New("not connected to MQTT broker")
+
+// errPublishTimeout is returned when the broker didn't acknowledge a message
+// in time. The client still has the message and may yet deliver it.
+var errPublishTimeout = errors.New("mqtt publish timeout")
+
+// BufferedReading is a lux reading taken while the broker was unreachable,
+// published to the backlog topic once it connects again.
+type BufferedReading struct {
+	Lux       int       `json:"lux"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// backlog holds the readings taken during a broker outage, dropping the
+// oldest ones once it is full.
+type backlog struct {
+	mu       sync.Mutex
+	size     int
+	readings []BufferedReading
+}
+
+func newBacklog(size int) *backlog {
+	return &backlog{size: size}
+}
+
+// add buffers readings after those already buffered.
+func (b *backlog) add(readings ...BufferedReading) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readings = append(b.readings, readings...)
+	if drop := len(b.readings) - b.size; drop > 0 {
+		b.readings = append(b.readings[:0], b.readings[drop:]...)
+	}
+}
+
+// prepend puts readings that could not be flushed back before those buffered
+// since.
+func (b *backlog) prepend(readings []BufferedReading) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readings = append(readings, b.readings...)
+	if drop := len(b.readings) - b.size; drop > 0 {
+		b.readings = b.readings[drop:]
+	}
+}
+
+// take removes and returns the buffered readings.
+func (b *backlog) take() []BufferedReading {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	readings := b.readings
+	b.readings = nil
+	return readings
+}
+
+// publish sends a message and waits until it is delivered. Nothing is sent
+// while the broker is unreachable. A message that failed is retried with
+// backoff, but only the first one of a cycle, so a broker outage doesn't hold
+// up the readings. One that timed out isn't sent again, as the client would
+// deliver it twice.
+func (p *Publisher) publish(ctx context.Context, topic string, qos byte, retained bool, payload interface{}) error {
+	for attempt := 0; ; attempt++ {
+		if !p.client.IsConnectionOpen() {
+			return errOffline
+		}
+		err := p.waitForPublish(ctx, p.client.Publish(topic, qos, retained, payload))
+		if err == nil || errors.Is(err, errPublishTimeout) || ctx.Err() != nil {
+			return err
+		}
+		if attempt == p.publishRetries || attempt == 0 && !p.takeRetry() {
+			return err
+		}
+		backoff := time.Duration(1<<attempt) * time.Second
+		log.Printf("Failed to publish to %s, retrying in %v: %v", topic, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// takeRetry reports whether a message that failed may be retried, which only
+// the first one in every interval between readings is.
+func (p *Publisher) takeRetry() bool {
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	if !p.lastRetry.IsZero() && time.Since(p.lastRetry) < p.interval {
+		return false
+	}
+	p.lastRetry = time.Now()
+	return true
+}
+
+// tolerate counts a message that could not be published and returns nil, so
+// that a broker outage doesn't stop the detector.
+func (p *Publisher) tolerate(err error) error {
+	if err == nil {
+		return nil
+	}
+	p.publishErrors.Add(1)
+	if !errors.Is(err, errOffline) {
+		log.Printf("Giving up on MQTT message: %v", err)
+	}
+	return nil
+}
+
+// PublishErrors returns the number of messages that could not be published
+// since the start, even after retrying.
+func (p *Publisher) PublishErrors() int64 {
+	return p.publishErrors.Load()
+}
+
+// flushBacklog publishes the readings buffered during an outage, oldest
+// first, as JSON with the time they were taken.
+func (p *Publisher) flushBacklog() {
+	readings := p.backlog.take()
+	if len(readings) == 0 {
+		return
+	}
+	log.Printf("Publishing %d readings buffered while the MQTT broker was unreachable", len(readings))
+	for i, reading := range readings {
+		payload, err := json.Marshal(reading)
+		if err != nil {
+			log.Printf("Dropping buffered reading: %v", err)
+			continue
+		}
+		if err := p.publish(context.Background(), p.backlogTopic, p.stateQoS, false, payload); err != nil {
+			log.Printf("Failed to publish buffered readings, keeping %d: %v", len(readings)-i, err)
+			p.backlog.prepend(readings[i:])
+			return
+		}
+	}
+}
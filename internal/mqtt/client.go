@@ -1,12 +1,23 @@
 package mqtt
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/jpeg"
 	"log"
+	"net"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"dark-detector/internal/config"
@@ -15,166 +26,1102 @@ import (
 )
 
 const (
-	connectionTimeout = 10 * time.Second
-	publishTimeout    = 10 * time.Second
+	// retainedStateWait is how long the broker gets to send the retained
+	// state. It arrives right after subscribing, if there is one.
+	retainedStateWait = 2 * time.Second
 )
 
+// client is the part of an MQTT client the Publisher uses. paho.mqtt.golang
+// speaks MQTT 3.1 and 3.1.1, v5Client speaks MQTT 5.
+type client interface {
+	Connect() mqtt.Token
+	Disconnect(quiesce uint)
+	IsConnectionOpen() bool
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+	Unsubscribe(topics ...string) mqtt.Token
+}
+
 // Publisher handles MQTT communication for light sensor data
 // including Home Assistant auto-discovery
 type Publisher struct {
-	client                 mqtt.Client
+	client                 client
+	baseTopic              string
 	topic                  string
+	histogramTopic         string
+	attributesTopic        string
 	entityName             string
+	device                 DiscoveryPayloadDevice
+	deviceDiscovery        bool // publish one device discovery config instead of one per entity
 	uniqueID               string
-	needToPublishDiscovery bool
+	needToPublishDiscovery atomic.Bool // set by the MQTT callbacks as well as the processing loop
 	autoDiscoveryTopic     string
+	discoveryTopicTemplate string
+	topicValues            topicValues // placeholders of the topic templates
 	autoDiscoveryEnabled   bool
 	availabilityTopic      string
+	statusTopic            string       // shared topic for whether the detector runs, empty when not used
+	cameraTopic            string       // topic for whether the camera answers, empty when not used
+	cameraPayload          atomic.Value // camera availability last published, unset before the first frame
+	payloadAvailable       string
+	payloadNotAvailable    string
+	unavailable            atomic.Bool
+	publishErrors          atomic.Int64
+	stateQoS               byte
+	stateRetain            bool
+	availabilityQoS        byte
+	availabilityRetain     bool
+	discoveryQoS           byte
+	discoveryRetain        bool
+	luxEnabled             bool
+	luxIcon                string
+	luxDeviceClass         string
+	snapshotQuality        int  // JPEG quality of the snapshots of the camera entity
+	forceUpdate            bool // have Home Assistant record readings equal to the last one
+	jsonState              bool
+	connectTimeout         time.Duration
+	publishTimeout         time.Duration
+	publishRetries         int
+	retryMu                sync.Mutex
+	lastRetry              time.Time     // when a failed message was last retried
+	interval               time.Duration // time between readings
+	expireAfter            int           // seconds until Home Assistant drops a sensor state, 0 to keep it
+	expireAfterCycles      int
+	attributesEnabled      bool
+	entities               []Entity
+	subscriptionsMu        sync.Mutex
+	subscriptions          map[string]func(payload []byte)
+	primaryBroker          string        // host:port of the first broker, empty with a single broker
+	failbackInterval       time.Duration // 0 to stay on a secondary broker until it fails
+	connMu                 sync.Mutex
+	conn                   net.Conn // latest connection to a broker, when failing over
+	broker                 string   // host:port of conn
+	backlog                *backlog // nil unless readings are buffered during broker outages
+	backlogTopic           string
+	onHomeAssistantOnline  func()               // called when Home Assistant restarts, may be nil
+	onConnectionChange     func(connected bool) // called when the connection is made or lost, may be nil
+	lastStatesMu           sync.Mutex
+	lastStates             map[string]interface{} // last payload of every state topic
 }
 
 // NewPublisher creates a configured MQTT client with automatic
-// reconnection and QoS 1 support
-func NewPublisher(cfg *config.Config) *Publisher {
+// reconnection and the configured QoS and retain flags
+func NewPublisher(cfg *config.Config) (*Publisher, error) {
 	entityName := cfg.HASSName
 	uniqueId := strings.ToLower(strings.ReplaceAll(entityName, " ", "_"))
-	topic := fmt.Sprintf("%s/%s/state", cfg.MQTTTopic, uniqueId)
-	availabilityTopic := fmt.Sprintf("%s/%s/availability", cfg.MQTTTopic, uniqueId)
+	values := topicValues{
+		"topic":     cfg.MQTTTopic,
+		"unique_id": uniqueId,
+		"name":      entityName,
+		"camera":    cameraName(cfg.ImageURL),
+	}
+	baseTopic := values.expand(cfg.MQTTBaseTopic)
+	values = values.with("base", baseTopic)
+	topic := values.expand(cfg.MQTTStateTopic)
+	availabilityTopic := values.expand(cfg.MQTTAvailabilityTopic)
+	statusTopic := values.expand(cfg.MQTTStatusTopic)
+	histogramTopic := baseTopic + "/histogram"
+	attributesTopic := baseTopic + "/attributes"
+	backlogTopic := baseTopic + "/backlog"
 	clientID := fmt.Sprintf("%s-%s", cfg.MQTTClientID, uniqueId)
+	suffix, err := clientIDSuffix(cfg.MQTTClientIDSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if suffix != "" {
+		clientID += "-" + suffix
+	}
 
 	p := &Publisher{
+		baseTopic:              baseTopic,
 		topic:                  topic,
+		histogramTopic:         histogramTopic,
+		attributesTopic:        attributesTopic,
+		backlogTopic:           backlogTopic,
 		entityName:             entityName,
+		device:                 newDevice(cfg, uniqueId, values),
+		deviceDiscovery:        cfg.HASSDiscoveryFormat == config.DiscoveryFormatDevice,
 		uniqueID:               uniqueId,
-		needToPublishDiscovery: true,
 		autoDiscoveryTopic:     cfg.HASSAutoDiscoveryTopic,
+		discoveryTopicTemplate: cfg.HASSDiscoveryTopic,
+		topicValues:            values,
 		autoDiscoveryEnabled:   cfg.HASSAutoDiscoveryEnabled,
 		availabilityTopic:      availabilityTopic,
+		statusTopic:            statusTopic,
+		cameraTopic:            values.expand(cfg.MQTTCameraTopic),
+		payloadAvailable:       cfg.MQTTPayloadAvailable,
+		payloadNotAvailable:    cfg.MQTTPayloadNotAvailable,
+		stateQoS:               cfg.MQTTStateQoS,
+		stateRetain:            cfg.MQTTStateRetain,
+		availabilityQoS:        cfg.MQTTAvailabilityQoS,
+		availabilityRetain:     cfg.MQTTAvailabilityRetain,
+		discoveryQoS:           cfg.MQTTDiscoveryQoS,
+		discoveryRetain:        cfg.MQTTDiscoveryRetain,
+		luxEnabled:             cfg.HasOutput(config.OutputLux),
+		luxDeviceClass:         "illuminance",
+		snapshotQuality:        cfg.CameraEntityQuality,
+		forceUpdate:            cfg.HASSForceUpdate,
+		jsonState:              cfg.MQTTStateJSONEnabled,
+		connectTimeout:         time.Duration(cfg.MQTTConnectTimeout) * time.Second,
+		publishTimeout:         time.Duration(cfg.MQTTPublishTimeout) * time.Second,
+		publishRetries:         cfg.MQTTPublishRetries,
+		interval:               time.Duration(cfg.Interval) * time.Second,
+		expireAfter:            cfg.ExpireAfterCycles * cfg.Interval,
+		expireAfterCycles:      cfg.ExpireAfterCycles,
+		subscriptions:          make(map[string]func(payload []byte)),
+		lastStates:             make(map[string]interface{}),
+		attributesEnabled:      cfg.SmoothingRawAttribute || cfg.DominantColorEnabled || cfg.SolarCheckEnabled || cfg.DiagnosticsEnabled,
+	}
+	p.needToPublishDiscovery.Store(true)
+	if cfg.MQTTBufferSize > 0 {
+		p.backlog = newBacklog(cfg.MQTTBufferSize)
+	}
+	if cfg.HasOutput(config.OutputLightness) {
+		p.entities = append(p.entities, lightnessEntity)
+	}
+	if cfg.HasOutput(config.OutputEV) {
+		p.entities = append(p.entities, evEntity)
+	}
+	if cfg.HasOutput(config.OutputLog10) {
+		p.entities = append(p.entities, logLuxEntity)
+	}
+	if cfg.LuminanceStatsEnabled {
+		p.entities = append(p.entities, stdDevEntity, contrastEntity)
+	}
+	if cfg.DarkEnabled {
+		p.entities = append(p.entities, newDarkEntity(cfg.DarkDeviceClass))
+	}
+	if cfg.IRModeEnabled {
+		p.entities = append(p.entities, irModeEntity)
+	}
+	if cfg.ColorTemperatureEnabled {
+		p.entities = append(p.entities, colorTempEntity)
+	}
+	if cfg.SharpnessEnabled {
+		p.entities = append(p.entities, sharpnessEntity)
+	}
+	if cfg.NoiseEnabled {
+		p.entities = append(p.entities, noiseEntity)
+	}
+	if cfg.DarkPixelsEnabled {
+		p.entities = append(p.entities, darkPixelsEntity)
+	}
+	if cfg.MotionEnabled {
+		p.entities = append(p.entities, motionEntity)
+	}
+	if cfg.TrendEnabled {
+		p.entities = append(p.entities, trendEntity)
+	}
+	if cfg.AggregateEnabled {
+		p.entities = append(p.entities, luxMinEntity, luxMaxEntity, luxMeanEntity)
+	}
+	for _, region := range cfg.Regions {
+		p.entities = append(p.entities, newRegionEntity(region))
+	}
+	if cfg.ClassificationEnabled {
+		p.entities = append(p.entities, newClassificationEntity(cfg.ClassificationBands))
+	}
+	if cfg.CameraEntityEnabled {
+		p.entities = append(p.entities, snapshotEntity)
+	}
+	if cfg.ImageEntityEnabled {
+		p.entities = append(p.entities, imageEntity)
+	}
+	if cfg.AnnotatedEntityEnabled {
+		p.entities = append(p.entities, annotatedEntity)
+	}
+	if cfg.HasOutput(config.OutputBrightness) {
+		p.entities = append(p.entities, brightnessEntity)
+	}
+	if cfg.LastErrorEnabled {
+		p.entities = append(p.entities, lastErrorEntity)
+	}
+	if cfg.DiagnosticsInterval > 0 && cfg.DiagnosticEntitiesEnabled {
+		p.entities = append(p.entities, diagnosticEntities...)
+		if !cfg.LastErrorEnabled {
+			p.entities = append(p.entities, newDiagnosticEntity(EntityLastError, "Last Error", "", ""))
+		}
+	}
+	if cfg.CalibrationEntitiesEnabled {
+		p.entities = append(p.entities, luxScaleEntity, calibrateDayEntity, calibrateNightEntity, cropEntity)
+	}
+	if cfg.EventsEnabled {
+		p.entities = append(p.entities, eventEntity)
+	}
+	if cfg.ButtonEntityEnabled && cfg.ImageTopic == "" {
+		p.entities = append(p.entities, refreshEntity)
+	}
+	if len(cfg.CropPresets) > 0 {
+		p.entities = append(p.entities, newCropPresetEntity(cfg.CropPresets))
+	}
+	if cfg.SwitchEntityEnabled {
+		p.entities = append(p.entities, enabledEntity)
+	}
+	if cfg.IntervalEntityEnabled {
+		p.entities = append(p.entities, intervalEntity)
+	}
+	if cfg.DarkEnabled && (cfg.CalibrationEntitiesEnabled || cfg.ThresholdEntityEnabled) {
+		p.entities = append(p.entities, darkThresholdEntity)
+	}
+	if err := p.applyOverrides(cfg); err != nil {
+		return nil, err
+	}
+
+	brokers := cfg.MQTTHosts
+	if len(brokers) == 0 {
+		broker, err := discoverBroker(cfg.MQTTTLSEnabled)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Discovered MQTT broker %s", broker)
+		brokers = []string{broker}
+	}
+	var tlsConfig *tls.Config
+	if cfg.MQTTTLSEnabled {
+		if tlsConfig, err = newTLSConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if len(brokers) > 1 {
+		// The client tries the brokers in order whenever it (re)connects
+		broker, err := url.Parse(brokers[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid MQTT broker %q: %w", brokers[0], err)
+		}
+		p.primaryBroker = broker.Host
+		p.failbackInterval = time.Duration(cfg.MQTTFailbackInterval) * time.Second
+	}
+
+	if cfg.MQTTProtocolVersion == 5 {
+		if p.client, err = p.newV5Client(cfg, clientID, brokers, tlsConfig); err != nil {
+			return nil, err
+		}
+		return p, nil
 	}
 
 	opts := mqtt.NewClientOptions().
-		AddBroker(cfg.MQTTHost).
 		SetClientID(clientID).
 		SetAutoReconnect(true).
-		SetMaxReconnectInterval(2*time.Minute).
-		SetKeepAlive(30*time.Second).
+		SetMaxReconnectInterval(time.Duration(cfg.MQTTMaxReconnectInterval)*time.Second).
+		SetKeepAlive(time.Duration(cfg.MQTTKeepAlive)*time.Second).
+		SetConnectTimeout(p.connectTimeout).
 		SetConnectRetry(true).
-		SetCleanSession(true).
+		SetConnectRetryInterval(time.Duration(cfg.MQTTConnectRetryInterval)*time.Second).
+		SetCleanSession(cfg.MQTTCleanSession).
+		SetResumeSubs(!cfg.MQTTCleanSession).
 		SetOrderMatters(false).
-		SetWill(availabilityTopic, "offline", 2, true).
+		SetWill(p.willTopic(), cfg.MQTTPayloadNotAvailable, cfg.MQTTAvailabilityQoS, cfg.MQTTAvailabilityRetain).
 		SetOnConnectHandler(func(client mqtt.Client) {
-			log.Println("Connected to MQTT broker")
-			// Publish online status
-			if token := client.Publish(availabilityTopic, 2, true, "online"); token.Wait() && token.Error() != nil {
-				log.Printf("Failed to publish online status: %v", token.Error())
-			}
-			if err := p.SubscribeHomeAssistantStatus(context.Background(), func() {
-				p.needToPublishDiscovery = true
-			}); err != nil {
-				log.Printf("Failed to subscribe to HA status: %v", err)
-			}
+			p.onConnect()
 		}).
 		SetConnectionLostHandler(func(client mqtt.Client, err error) {
-			log.Printf("Connection to MQTT broker lost: %v", err)
+			p.onConnectionLost(err)
+		}).
+		SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+			log.Println("Reconnecting to MQTT broker")
 		})
 
-	if cfg.MQTTUsername != "" && cfg.MQTTPassword != "" {
+	// Some brokers authenticate with a token as the username alone
+	if cfg.MQTTUsername != "" {
 		opts.SetUsername(cfg.MQTTUsername)
 		opts.SetPassword(cfg.MQTTPassword)
 	}
+	for _, broker := range brokers {
+		opts.AddBroker(broker)
+	}
+	if p.primaryBroker != "" {
+		opts.SetCustomOpenConnectionFn(func(broker *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+			return p.openConnection(context.Background(), broker, options.ConnectTimeout, options.TLSConfig)
+		})
+	}
+	if cfg.MQTTProtocolVersion != 0 {
+		opts.SetProtocolVersion(cfg.MQTTProtocolVersion)
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 
 	p.client = mqtt.NewClient(opts)
-	return p
+	return p, nil
+}
+
+// onConnect announces the detector and renews its subscriptions whenever the
+// connection to the broker is made.
+func (p *Publisher) onConnect() {
+	if broker := p.connectedBroker(); broker != "" {
+		log.Printf("Connected to MQTT broker %s", broker)
+	} else {
+		log.Println("Connected to MQTT broker")
+	}
+	// Publish online status, unless the detector marked itself unavailable
+	if token := p.client.Publish(p.availabilityTopic, p.availabilityQoS, p.availabilityRetain, p.availabilityPayload()); token.Wait() && token.Error() != nil {
+		log.Printf("Failed to publish online status: %v", token.Error())
+	}
+	if p.statusTopic != "" {
+		if token := p.client.Publish(p.statusTopic, p.availabilityQoS, p.availabilityRetain, p.payloadAvailable); token.Wait() && token.Error() != nil {
+			log.Printf("Failed to publish online status: %v", token.Error())
+		}
+	}
+	if payload, ok := p.cameraPayload.Load().(string); ok {
+		if token := p.client.Publish(p.cameraTopic, p.availabilityQoS, p.availabilityRetain, payload); token.Wait() && token.Error() != nil {
+			log.Printf("Failed to publish camera status: %v", token.Error())
+		}
+	}
+	if err := p.SubscribeHomeAssistantStatus(context.Background(), func() {
+		p.needToPublishDiscovery.Store(true)
+		if p.onHomeAssistantOnline != nil {
+			p.onHomeAssistantOnline()
+		}
+	}); err != nil {
+		log.Printf("Failed to subscribe to HA status: %v", err)
+	}
+	if p.backlog != nil {
+		go p.flushBacklog()
+	}
+	if p.onConnectionChange != nil {
+		p.onConnectionChange(true)
+	}
+	// Subscriptions don't outlive a clean session, renew them. A
+	// persistent session kept them, but renewing does no harm.
+	p.subscriptionsMu.Lock()
+	defer p.subscriptionsMu.Unlock()
+	for topic, handler := range p.subscriptions {
+		if err := p.subscribe(context.Background(), topic, handler); err != nil {
+			log.Printf("Failed to subscribe to %s: %v", topic, err)
+		}
+	}
+}
+
+// onConnectionLost reports that the connection to the broker dropped. The
+// client reconnects on its own.
+func (p *Publisher) onConnectionLost(err error) {
+	log.Printf("Connection to MQTT broker lost: %v", err)
+	if p.onConnectionChange != nil {
+		p.onConnectionChange(false)
+	}
+}
+
+// clientIDSuffix returns what is appended to the client ID, so several
+// detectors with the same configuration don't keep disconnecting each other
+// from the broker.
+func clientIDSuffix(mode string) (string, error) {
+	switch mode {
+	case config.ClientIDSuffixHostname:
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("failed to get hostname for the MQTT client ID: %w", err)
+		}
+		return strings.ToLower(hostname), nil
+	case config.ClientIDSuffixRandom:
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("failed to generate MQTT client ID: %w", err)
+		}
+		return hex.EncodeToString(b), nil
+	default:
+		return "", nil
+	}
 }
 
 func (p *Publisher) Connect(ctx context.Context) error {
 	token := p.client.Connect()
 
-	timer := time.NewTimer(connectionTimeout)
+	timer := time.NewTimer(p.connectTimeout)
 	defer timer.Stop()
 
 	select {
 	case <-ctx.Done():
 		return fmt.Errorf("MQTT connection cancelled: %w", ctx.Err())
 	case <-timer.C:
-		return fmt.Errorf("MQTT connection timeout")
+		if p.backlog == nil {
+			return fmt.Errorf("MQTT connection timeout")
+		}
+		// The client keeps trying in the background
+		log.Println("MQTT broker is unreachable, buffering readings until it connects")
 	case <-waitForToken(token):
 		if err := token.Error(); err != nil {
 			return fmt.Errorf("MQTT connection error: %w", err)
 		}
-		return nil
 	}
+
+	if p.primaryBroker != "" && p.failbackInterval > 0 {
+		go p.failBack(ctx, p.failbackInterval)
+	}
+	return nil
 }
 
 func (p *Publisher) Disconnect() {
 	// Publish offline status manually
-	token := p.client.Publish(p.availabilityTopic, 2, true, "offline")
+	token := p.client.Publish(p.availabilityTopic, p.availabilityQoS, p.availabilityRetain, p.payloadNotAvailable)
 	token.Wait()
+	if p.statusTopic != "" {
+		token := p.client.Publish(p.statusTopic, p.availabilityQoS, p.availabilityRetain, p.payloadNotAvailable)
+		token.Wait()
+	}
 	p.client.Disconnect(250)
 }
 
+// SetAvailable marks the sensor available or unavailable in Home Assistant,
+// e.g. while the camera feed is frozen and readings can't be trusted.
+func (p *Publisher) SetAvailable(ctx context.Context, available bool) error {
+	p.unavailable.Store(!available)
+	// Published when the connection is made again otherwise
+	if err := p.publish(ctx, p.availabilityTopic, p.availabilityQoS, p.availabilityRetain, p.availabilityPayload()); err != nil {
+		return p.tolerate(fmt.Errorf("failed to publish availability: %w", err))
+	}
+	return nil
+}
+
+// SetCameraAvailable publishes whether the camera delivered the last frame,
+// so Home Assistant shows the readings unavailable while the camera is down
+// even though the detector runs. Only changes are published.
+func (p *Publisher) SetCameraAvailable(ctx context.Context, available bool) error {
+	if p.cameraTopic == "" {
+		return nil
+	}
+	payload := p.payloadNotAvailable
+	if available {
+		payload = p.payloadAvailable
+	}
+	if last, ok := p.cameraPayload.Load().(string); ok && last == payload {
+		return nil
+	}
+	if err := p.publish(ctx, p.cameraTopic, p.availabilityQoS, p.availabilityRetain, payload); err != nil {
+		return p.tolerate(fmt.Errorf("failed to publish camera availability: %w", err))
+	}
+	p.cameraPayload.Store(payload)
+	return nil
+}
+
+func (p *Publisher) availabilityPayload() string {
+	if p.unavailable.Load() {
+		return p.payloadNotAvailable
+	}
+	return p.payloadAvailable
+}
+
+// willTopic returns the topic the broker marks the detector unavailable on
+// when the connection drops. With a status topic, the sensor availability is
+// left to what the detector last published.
+func (p *Publisher) willTopic() string {
+	if p.statusTopic != "" {
+		return p.statusTopic
+	}
+	return p.availabilityTopic
+}
+
+// availability returns the topics Home Assistant reads the availability of
+// the entities from.
+func (p *Publisher) availability() []Availability {
+	availability := []Availability{{
+		Topic:               p.availabilityTopic,
+		PayloadAvailable:    p.payloadAvailable,
+		PayloadNotAvailable: p.payloadNotAvailable,
+	}}
+	for _, topic := range []string{p.statusTopic, p.cameraTopic} {
+		if topic != "" {
+			availability = append(availability, Availability{
+				Topic:               topic,
+				PayloadAvailable:    p.payloadAvailable,
+				PayloadNotAvailable: p.payloadNotAvailable,
+			})
+		}
+	}
+	return availability
+}
+
+// deviceAvailability returns the topic Home Assistant reads the availability
+// of entities that don't depend on the camera feed from, such as settings and
+// diagnostics. Only a status topic tells apart the detector running from the
+// feed being usable.
+func (p *Publisher) deviceAvailability() []Availability {
+	topic := p.statusTopic
+	if topic == "" {
+		topic = p.availabilityTopic
+	}
+	return []Availability{{
+		Topic:               topic,
+		PayloadAvailable:    p.payloadAvailable,
+		PayloadNotAvailable: p.payloadNotAvailable,
+	}}
+}
+
+// availabilityMode returns how Home Assistant combines the availability
+// topics, empty with a single one.
+func (p *Publisher) availabilityMode() string {
+	if p.statusTopic != "" || p.cameraTopic != "" {
+		return "all"
+	}
+	return ""
+}
+
 type DiscoveryPayload struct {
-	Name              string                 `json:"name"`
-	DeviceClass       string                 `json:"device_class"`
-	StateTopic        string                 `json:"state_topic"`
-	UnitOfMeasurement string                 `json:"unit_of_measurement"`
-	UniqueID          string                 `json:"unique_id"`
-	AvailabilityTopic string                 `json:"availability_topic"`
-	Device            DiscoveryPayloadDevice `json:"device"`
-	HasEntityName     bool                   `json:"has_entity_name"`
+	Name                string                  `json:"name"`
+	DeviceClass         string                  `json:"device_class,omitempty"`
+	Icon                string                  `json:"icon,omitempty"`
+	StateTopic          string                  `json:"state_topic,omitempty"`
+	ImageTopic          string                  `json:"image_topic,omitempty"`
+	Topic               string                  `json:"topic,omitempty"`
+	ContentType         string                  `json:"content_type,omitempty"`
+	UnitOfMeasurement   string                  `json:"unit_of_measurement,omitempty"`
+	UniqueID            string                  `json:"unique_id"`
+	Availability        []Availability          `json:"availability"`
+	AvailabilityMode    string                  `json:"availability_mode,omitempty"`
+	ExpireAfter         int                     `json:"expire_after,omitempty"`
+	ForceUpdate         bool                    `json:"force_update,omitempty"`
+	EntityCategory      string                  `json:"entity_category,omitempty"`
+	ValueTemplate       string                  `json:"value_template,omitempty"`
+	JSONAttributesTopic string                  `json:"json_attributes_topic,omitempty"`
+	Options             []string                `json:"options,omitempty"`
+	EventTypes          []string                `json:"event_types,omitempty"`
+	CommandTopic        string                  `json:"command_topic,omitempty"`
+	Min                 *float64                `json:"min,omitempty"`
+	Max                 *float64                `json:"max,omitempty"`
+	Step                float64                 `json:"step,omitempty"`
+	Mode                string                  `json:"mode,omitempty"`
+	Device              *DiscoveryPayloadDevice `json:"device,omitempty"`
+	HasEntityName       bool                    `json:"has_entity_name"`
+}
+
+// DeviceDiscoveryPayload configures the device and all of its entities in one
+// message, with HASS_DISCOVERY_FORMAT=device.
+type DeviceDiscoveryPayload struct {
+	Device     DiscoveryPayloadDevice     `json:"device"`
+	Origin     DiscoveryPayloadOrigin     `json:"origin"`
+	Components map[string]DeviceComponent `json:"components"`
+}
+
+// DeviceComponent is the config of one entity in a device discovery payload.
+type DeviceComponent struct {
+	Platform string `json:"platform"`
+	DiscoveryPayload
+}
+
+// DiscoveryPayloadOrigin tells Home Assistant what published the discovery
+// config, which device discovery requires.
+type DiscoveryPayloadOrigin struct {
+	Name      string `json:"name"`
+	SWVersion string `json:"sw_version,omitempty"`
+}
+
+// Availability is a topic Home Assistant reads the availability of an entity from.
+type Availability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
 }
 
 type DiscoveryPayloadDevice struct {
-	Name         string `json:"name"`
-	Identifiers  string `json:"identifiers"`
-	Manufacturer string `json:"manufacturer"`
-	Model        string `json:"model"`
+	Name             string `json:"name"`
+	Identifiers      string `json:"identifiers"`
+	Manufacturer     string `json:"manufacturer"`
+	Model            string `json:"model"`
+	SWVersion        string `json:"sw_version,omitempty"` // version or commit the detector was built from
+	ConfigurationURL string `json:"configuration_url,omitempty"`
+	SuggestedArea    string `json:"suggested_area,omitempty"`
+	ViaDevice        string `json:"via_device,omitempty"` // identifier of the device the detector reads, e.g. the camera
+}
+
+// StatePayload is the lux state published as JSON with MQTT_STATE_JSON_ENABLED.
+type StatePayload struct {
+	Lux            int            `json:"lux"`
+	Brightness     float64        `json:"brightness"`
+	Timestamp      time.Time      `json:"timestamp"`
+	FrameAge       float64        `json:"frame_age"` // seconds between taking the frame and publishing its reading
+	Regions        map[string]int `json:"regions,omitempty"`
+	Classification string         `json:"classification,omitempty"`
+}
+
+// DiagnosticsPayload holds the runtime stats published with DIAGNOSTICS_INTERVAL.
+type DiagnosticsPayload struct {
+	Uptime          int64   `json:"uptime"`    // seconds since the start
+	Cycles          int     `json:"cycles"`    // readings published
+	FrameAge        float64 `json:"frame_age"` // seconds between taking the last frame and publishing its reading
+	FetchFailures   int     `json:"fetch_failures"`
+	DecodeFailures  int     `json:"decode_failures"`
+	PublishFailures int64   `json:"publish_failures"`
+	LastError       string  `json:"last_error"`
+}
+
+// EventPayload is an event of the event entity. Fields other than the event
+// type become attributes of the event in Home Assistant.
+type EventPayload struct {
+	EventType string `json:"event_type"`
+	FromLux   int    `json:"from_lux"`
+	ToLux     int    `json:"to_lux"`
+}
+
+type HistogramPayload struct {
+	Buckets []int `json:"buckets"`
+}
+
+// PublishLux publishes the lux state, as a bare number or, with JSON state
+// enabled, along with the rest of the reading.
+func (p *Publisher) PublishLux(ctx context.Context, state StatePayload) error {
+	// Publish state, unless lux was left out of the selected outputs
+	if p.luxEnabled {
+		var statePayload interface{} = strconv.Itoa(state.Lux)
+		if p.jsonState {
+			payload, err := json.Marshal(state)
+			if err != nil {
+				return fmt.Errorf("failed to marshal state payload: %w", err)
+			}
+			statePayload = payload
+		}
+		p.rememberState(p.topic, statePayload)
+		if err := p.publish(ctx, p.topic, p.stateQoS, p.stateRetain, statePayload); err != nil {
+			if p.backlog != nil {
+				p.backlog.add(BufferedReading{Lux: state.Lux, Timestamp: state.Timestamp})
+			}
+			return p.tolerate(fmt.Errorf("failed to publish state: %w", err))
+		}
+	}
+
+	return p.PublishDiscovery(ctx)
+}
+
+// RetainedState returns the lux state the broker retained from before the
+// detector restarted, or nil when there is none. Its Timestamp is only set
+// for JSON states.
+func (p *Publisher) RetainedState(ctx context.Context) (*StatePayload, error) {
+	if !p.luxEnabled || !p.client.IsConnectionOpen() {
+		return nil, nil
+	}
+
+	payloads := make(chan []byte, 1)
+	token := p.client.Subscribe(p.topic, p.stateQoS, func(client mqtt.Client, msg mqtt.Message) {
+		if msg.Retained() {
+			select {
+			case payloads <- msg.Payload():
+			default:
+			}
+		}
+	})
+	if err := p.waitForPublish(ctx, token); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to state: %w", err)
+	}
+	defer func() {
+		if err := p.waitForPublish(ctx, p.client.Unsubscribe(p.topic)); err != nil {
+			log.Printf("Failed to unsubscribe from state: %v", err)
+		}
+	}()
+
+	timer := time.NewTimer(retainedStateWait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, nil
+	case payload := <-payloads:
+		var state StatePayload
+		if p.jsonState {
+			if err := json.Unmarshal(payload, &state); err != nil {
+				return nil, fmt.Errorf("failed to parse retained state: %w", err)
+			}
+			return &state, nil
+		}
+		lux, err := strconv.Atoi(strings.TrimSpace(string(payload)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse retained state: %w", err)
+		}
+		state.Lux = lux
+		return &state, nil
+	}
+}
+
+// OnHomeAssistantOnline sets a function called whenever Home Assistant
+// announces that it (re)started. It runs on the MQTT client's goroutine and
+// must be set before connecting.
+func (p *Publisher) OnHomeAssistantOnline(handler func()) {
+	p.onHomeAssistantOnline = handler
+}
+
+// OnConnectionChange sets a function called whenever the connection to the
+// broker is made or lost, e.g. to report it in a health check. It runs on the
+// MQTT client's goroutine and must be set before connecting.
+func (p *Publisher) OnConnectionChange(handler func(connected bool)) {
+	p.onConnectionChange = handler
+}
+
+// RepublishStates publishes the discovery config and the last published
+// states again, so entities don't stay unknown after Home Assistant restarts
+// until the next reading.
+func (p *Publisher) RepublishStates(ctx context.Context) error {
+	if err := p.PublishDiscovery(ctx); err != nil {
+		return err
+	}
+	p.lastStatesMu.Lock()
+	states := make(map[string]interface{}, len(p.lastStates))
+	for topic, payload := range p.lastStates {
+		states[topic] = payload
+	}
+	p.lastStatesMu.Unlock()
+
+	for topic, payload := range states {
+		if err := p.publish(ctx, topic, p.stateQoS, p.stateRetain, payload); err != nil {
+			return p.tolerate(fmt.Errorf("failed to republish state: %w", err))
+		}
+	}
+	return nil
+}
+
+// rememberState keeps the payload published to a state topic for RepublishStates.
+func (p *Publisher) rememberState(topic string, payload interface{}) {
+	p.lastStatesMu.Lock()
+	defer p.lastStatesMu.Unlock()
+	p.lastStates[topic] = payload
+}
+
+// PublishState publishes the state of one of the additional entities.
+// States of entities that are not enabled in the configuration are ignored.
+func (p *Publisher) PublishState(ctx context.Context, key string, value string) error {
+	if !p.hasEntity(key) {
+		return nil
+	}
+	p.rememberState(p.entityStateTopic(key), value)
+	if err := p.publish(ctx, p.entityStateTopic(key), p.stateQoS, p.stateRetain, value); err != nil {
+		return p.tolerate(fmt.Errorf("failed to publish %s state: %w", key, err))
+	}
+	return nil
+}
+
+// PublishStates publishes the states of several additional entities, keyed by entity key.
+func (p *Publisher) PublishStates(ctx context.Context, states map[string]string) error {
+	for key, value := range states {
+		if err := p.PublishState(ctx, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Publisher) entityStateTopic(key string) string {
+	return fmt.Sprintf("%s/%s", p.baseTopic, key)
+}
+
+func (p *Publisher) commandTopic(key string) string {
+	return p.entityStateTopic(key) + "/set"
+}
+
+// SubscribeCommand calls handler with the values Home Assistant sends to the
+// entity with the given key. Entities that are not enabled are ignored.
+func (p *Publisher) SubscribeCommand(ctx context.Context, key string, handler func(value string)) error {
+	if !p.hasEntity(key) {
+		return nil
+	}
+	return p.Subscribe(ctx, p.commandTopic(key), func(payload []byte) {
+		handler(strings.TrimSpace(string(payload)))
+	})
+}
+
+// SubscribeAction calls handler whenever a message is published to the topic
+// of the given action, such as ActionPoll.
+func (p *Publisher) SubscribeAction(ctx context.Context, action string, handler func()) error {
+	return p.Subscribe(ctx, p.entityStateTopic(action), func(payload []byte) {
+		handler()
+	})
+}
+
+// PublishImage publishes the image returned by render as the JPEG of an image
+// entity. Render is only called for entities enabled in the configuration.
+func (p *Publisher) PublishImage(ctx context.Context, key string, render func() image.Image) error {
+	if !p.hasEntity(key) {
+		return nil
+	}
+	img := render()
+	if img == nil {
+		return nil
+	}
+	var options *jpeg.Options
+	if key == EntitySnapshot {
+		options = &jpeg.Options{Quality: p.snapshotQuality}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, options); err != nil {
+		return fmt.Errorf("failed to encode %s: %w", key, err)
+	}
+
+	topic := p.entityStateTopic(key)
+	p.rememberState(topic, buf.Bytes())
+	if err := p.publish(ctx, topic, p.stateQoS, p.stateRetain, buf.Bytes()); err != nil {
+		return p.tolerate(fmt.Errorf("failed to publish %s: %w", key, err))
+	}
+	return nil
+}
+
+// PublishHistogram publishes the per-frame luminance histogram as JSON.
+func (p *Publisher) PublishHistogram(ctx context.Context, histogram []int) error {
+	payload, err := json.Marshal(HistogramPayload{Buckets: histogram})
+	if err != nil {
+		return fmt.Errorf("failed to marshal histogram payload: %w", err)
+	}
+
+	if err := p.publish(ctx, p.histogramTopic, p.stateQoS, p.stateRetain, payload); err != nil {
+		return p.tolerate(fmt.Errorf("failed to publish histogram: %w", err))
+	}
+	return nil
+}
+
+// PublishEvent fires an event of the event entity with the given key. Events
+// are neither retained nor republished, so Home Assistant sees each once.
+func (p *Publisher) PublishEvent(ctx context.Context, key string, event EventPayload) error {
+	if !p.hasEntity(key) {
+		return nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event payload: %w", err)
+	}
+
+	if err := p.publish(ctx, p.entityStateTopic(key), p.stateQoS, false, payload); err != nil {
+		return p.tolerate(fmt.Errorf("failed to publish %s event: %w", event.EventType, err))
+	}
+	return nil
 }
 
-func (p *Publisher) PublishLux(ctx context.Context, lux int) error {
-	// Publish state
-	statePayload := strconv.Itoa(lux)
-	token := p.client.Publish(p.topic, 1, false, statePayload)
-	if err := waitForPublish(ctx, token); err != nil {
-		return fmt.Errorf("failed to publish state: %w", err)
+// PublishDiagnostics publishes the runtime stats of the detector as JSON.
+func (p *Publisher) PublishDiagnostics(ctx context.Context, diagnostics DiagnosticsPayload) error {
+	payload, err := json.Marshal(diagnostics)
+	if err != nil {
+		return fmt.Errorf("failed to marshal diagnostics payload: %w", err)
 	}
 
+	topic := p.entityStateTopic(diagnosticsKey)
+	p.rememberState(topic, payload)
+	if err := p.publish(ctx, topic, p.stateQoS, p.stateRetain, payload); err != nil {
+		return p.tolerate(fmt.Errorf("failed to publish diagnostics: %w", err))
+	}
 	return p.PublishDiscovery(ctx)
 }
 
+// PublishAttributes publishes extra attributes of the lux sensor as JSON.
+func (p *Publisher) PublishAttributes(ctx context.Context, attributes map[string]interface{}) error {
+	if !p.attributesEnabled {
+		return nil
+	}
+
+	payload, err := json.Marshal(attributes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attributes payload: %w", err)
+	}
+
+	p.rememberState(p.attributesTopic, payload)
+	if err := p.publish(ctx, p.attributesTopic, p.stateQoS, p.stateRetain, payload); err != nil {
+		return p.tolerate(fmt.Errorf("failed to publish attributes: %w", err))
+	}
+	return nil
+}
+
+// SetInterval changes the interval the expiry of the sensor states and the
+// retries of failed messages are based on. The discovery configs are
+// republished with the next reading.
+func (p *Publisher) SetInterval(interval time.Duration) {
+	p.retryMu.Lock()
+	p.interval = interval
+	p.retryMu.Unlock()
+	expireAfter := p.expireAfterCycles * int(interval/time.Second)
+	if expireAfter != p.expireAfter {
+		p.expireAfter = expireAfter
+		p.needToPublishDiscovery.Store(true)
+	}
+}
+
 func (p *Publisher) PublishDiscovery(ctx context.Context) error {
-	if !p.autoDiscoveryEnabled || !p.needToPublishDiscovery {
+	// Cleared up front, so a request made while publishing isn't lost
+	if !p.autoDiscoveryEnabled || !p.needToPublishDiscovery.Swap(false) {
 		return nil
 	}
 
-	// Home Assistant discovery config
-	discoveryTopic := fmt.Sprintf("%s/sensor/%s/config", p.autoDiscoveryTopic, p.uniqueID)
-	payload := DiscoveryPayload{
-		Name:              p.entityName,
-		DeviceClass:       "illuminance",
-		StateTopic:        p.topic,
-		UnitOfMeasurement: "lx",
-		UniqueID:          p.uniqueID,
-		AvailabilityTopic: p.availabilityTopic,
-		HasEntityName:     true,
-		Device: DiscoveryPayloadDevice{
-			Name:         "Dark Detector",
-			Identifiers:  p.uniqueID,
-			Manufacturer: "Markis Taylor",
-			Model:        "darkdetector",
-		},
+	configs := p.discoveryConfigs()
+	if p.deviceDiscovery {
+		if err := p.publishDeviceDiscovery(ctx, configs); err != nil {
+			// Left for the next reading while the broker is unreachable
+			p.needToPublishDiscovery.Store(true)
+			return p.tolerate(err)
+		}
+	} else {
+		for _, c := range configs {
+			topic := p.discoveryTopic(c.component, c.payload.UniqueID)
+			if err := p.publishDiscoveryPayload(ctx, topic, c.payload); err != nil {
+				p.needToPublishDiscovery.Store(true)
+				return p.tolerate(err)
+			}
+		}
+	}
+	return nil
+}
+
+// discoveryConfig is the Home Assistant discovery config of one entity.
+type discoveryConfig struct {
+	component string
+	payload   DiscoveryPayload
+}
+
+// discoveryConfigs returns the discovery configs of the lux sensor and every
+// additional entity that is enabled.
+func (p *Publisher) discoveryConfigs() []discoveryConfig {
+	device := p.device
+	configs := make([]discoveryConfig, 0, len(p.entities)+1)
+
+	if p.luxEnabled {
+		payload := DiscoveryPayload{
+			Name:              p.entityName,
+			DeviceClass:       p.luxDeviceClass,
+			Icon:              p.luxIcon,
+			StateTopic:        p.topic,
+			UnitOfMeasurement: "lx",
+			UniqueID:          p.uniqueID,
+			Availability:      p.availability(),
+			AvailabilityMode:  p.availabilityMode(),
+			ExpireAfter:       p.expireAfter,
+			ForceUpdate:       p.forceUpdate,
+			HasEntityName:     true,
+			Device:            &device,
+		}
+		if p.jsonState {
+			// The rest of the reading shows up as attributes, unless there are extra ones
+			payload.ValueTemplate = "{{ value_json.lux }}"
+			payload.JSONAttributesTopic = p.topic
+		}
+		if p.attributesEnabled {
+			payload.JSONAttributesTopic = p.attributesTopic
+		}
+		configs = append(configs, discoveryConfig{component: "sensor", payload: payload})
 	}
+
+	for _, entity := range p.entities {
+		payload := DiscoveryPayload{
+			Name:              entity.Name,
+			DeviceClass:       entity.DeviceClass,
+			Icon:              entity.Icon,
+			StateTopic:        p.entityStateTopic(entity.stateKey()),
+			UnitOfMeasurement: entity.UnitOfMeasurement,
+			ValueTemplate:     entity.ValueTemplate,
+			EntityCategory:    entity.EntityCategory,
+			Options:           entity.Options,
+			UniqueID:          fmt.Sprintf("%s_%s", p.uniqueID, entity.Key),
+			Availability:      p.deviceAvailability(),
+			HasEntityName:     true,
+			Device:            &device,
+		}
+		if entity.measured() {
+			payload.Availability = p.availability()
+			payload.AvailabilityMode = p.availabilityMode()
+			payload.ExpireAfter = p.expireAfter
+			payload.ForceUpdate = p.forceUpdate
+		}
+		switch entity.Component {
+		case "image":
+			// Images are published as raw bytes rather than a state
+			payload.StateTopic = ""
+			payload.ImageTopic = p.entityStateTopic(entity.Key)
+			payload.ContentType = "image/jpeg"
+		case "camera":
+			// Cameras read the raw bytes of the snapshots from a topic of their own
+			payload.StateTopic = ""
+			payload.Topic = p.entityStateTopic(entity.Key)
+		case "number":
+			payload.CommandTopic = p.commandTopic(entity.Key)
+			payload.Min = &entity.Min
+			payload.Max = &entity.Max
+			payload.Step = entity.Step
+			payload.Mode = "box"
+		case "text":
+			payload.CommandTopic = p.commandTopic(entity.Key)
+			payload.Max = &entity.Max
+		case "button":
+			// Pressing the button publishes to the topic of its action
+			payload.StateTopic = ""
+			payload.CommandTopic = p.entityStateTopic(entity.Key)
+		case "select":
+			payload.CommandTopic = p.commandTopic(entity.Key)
+		case "event":
+			payload.Options = nil
+			payload.EventTypes = entity.Options
+		case "switch":
+			// The default ON and OFF payloads match the published states
+			payload.CommandTopic = p.commandTopic(entity.Key)
+		}
+		configs = append(configs, discoveryConfig{component: entity.Component, payload: payload})
+	}
+	return configs
+}
+
+// publishDeviceDiscovery publishes the discovery configs of all entities in a
+// single device discovery message.
+func (p *Publisher) publishDeviceDiscovery(ctx context.Context, configs []discoveryConfig) error {
+	payload := DeviceDiscoveryPayload{
+		Device:     p.device,
+		Origin:     DiscoveryPayloadOrigin{Name: "dark-detector", SWVersion: p.device.SWVersion},
+		Components: make(map[string]DeviceComponent, len(configs)),
+	}
+	for _, c := range configs {
+		// The device is given once for all components
+		c.payload.Device = nil
+		payload.Components[c.payload.UniqueID] = DeviceComponent{Platform: c.component, DiscoveryPayload: c.payload}
+	}
+
+	discoveryPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device discovery payload: %w", err)
+	}
+	if err := p.publish(ctx, p.discoveryTopic("device", p.uniqueID), p.discoveryQoS, p.discoveryRetain, discoveryPayload); err != nil {
+		return fmt.Errorf("failed to publish device discovery config: %w", err)
+	}
+	return nil
+}
+
+// DiscoveryTopics returns the topics the discovery configs are published to.
+func (p *Publisher) DiscoveryTopics() []string {
+	if p.deviceDiscovery {
+		return []string{p.discoveryTopic("device", p.uniqueID)}
+	}
+	return p.entityDiscoveryTopics()
+}
+
+func (p *Publisher) entityDiscoveryTopics() []string {
+	configs := p.discoveryConfigs()
+	topics := make([]string, len(configs))
+	for i, c := range configs {
+		topics[i] = p.discoveryTopic(c.component, c.payload.UniqueID)
+	}
+	return topics
+}
+
+// RemoveDiscovery clears the retained discovery configs of the enabled
+// entities in both formats, which removes them from Home Assistant.
+func (p *Publisher) RemoveDiscovery(ctx context.Context) error {
+	topics := append(p.entityDiscoveryTopics(), p.discoveryTopic("device", p.uniqueID))
+	if err := p.ClearDiscovery(ctx, topics); err != nil {
+		return err
+	}
+	log.Printf("Removed %d discovery configs", len(topics))
+	return nil
+}
+
+// ClearDiscovery clears the retained discovery configs on the given topics.
+func (p *Publisher) ClearDiscovery(ctx context.Context, topics []string) error {
+	for _, topic := range topics {
+		// An empty retained message deletes the one the broker kept
+		if err := p.publish(ctx, topic, p.discoveryQoS, true, ""); err != nil {
+			return fmt.Errorf("failed to remove discovery config %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+func (p *Publisher) publishDiscoveryPayload(ctx context.Context, topic string, payload DiscoveryPayload) error {
 	discoveryPayload, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal discovery payload: %w", err)
 	}
 
 	// Publish discovery config
-	token := p.client.Publish(discoveryTopic, 1, true, discoveryPayload)
-	if err := waitForPublish(ctx, token); err != nil {
+	if err := p.publish(ctx, topic, p.discoveryQoS, p.discoveryRetain, discoveryPayload); err != nil {
 		return fmt.Errorf("failed to publish discovery config: %w", err)
 	}
-
-	p.needToPublishDiscovery = false
 	return nil
 }
 
@@ -194,22 +1141,46 @@ func (p *Publisher) SubscribeHomeAssistantStatus(ctx context.Context, onOnline f
 		}
 	})
 
-	if err := waitForPublish(ctx, token); err != nil {
+	if err := p.waitForPublish(ctx, token); err != nil {
 		return fmt.Errorf("failed to subscribe to Home Assistant status: %w", err)
 	}
 	return nil
 }
 
+// Subscribe calls handler with the payload of every message published to topic.
+// The subscription is renewed whenever the connection to the broker is
+// re-established. Handlers run on the MQTT client's goroutine.
+func (p *Publisher) Subscribe(ctx context.Context, topic string, handler func(payload []byte)) error {
+	p.subscriptionsMu.Lock()
+	defer p.subscriptionsMu.Unlock()
+	p.subscriptions[topic] = handler
+	if !p.client.IsConnectionOpen() {
+		// Subscribed once the connection is made
+		return nil
+	}
+	return p.subscribe(ctx, topic, handler)
+}
+
+func (p *Publisher) subscribe(ctx context.Context, topic string, handler func(payload []byte)) error {
+	token := p.client.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		handler(msg.Payload())
+	})
+	if err := p.waitForPublish(ctx, token); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+	}
+	return nil
+}
+
 // Helper function to wait for MQTT publish
-func waitForPublish(ctx context.Context, token mqtt.Token) error {
-	timer := time.NewTimer(publishTimeout)
+func (p *Publisher) waitForPublish(ctx context.Context, token mqtt.Token) error {
+	timer := time.NewTimer(p.publishTimeout)
 	defer timer.Stop()
 
 	select {
 	case <-ctx.Done():
 		return fmt.Errorf("publish cancelled: %w", ctx.Err())
 	case <-timer.C:
-		return fmt.Errorf("mqtt publish timeout after 10s")
+		return fmt.Errorf("%w after %v", errPublishTimeout, p.publishTimeout)
 	case <-waitForToken(token):
 		if err := token.Error(); err != nil {
 			return fmt.Errorf("mqtt publish error: %w", err)
@@ -0,0 +1,80 @@
+package mqtt
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"dark-detector/internal/config"
+)
+
+// newDevice returns the Home Assistant device the entities belong to.
+func newDevice(cfg *config.Config, uniqueID string, values topicValues) DiscoveryPayloadDevice {
+	return DiscoveryPayloadDevice{
+		Name:             values.expand(cfg.HASSDeviceName),
+		Identifiers:      uniqueID,
+		Manufacturer:     "Markis Taylor",
+		Model:            "darkdetector",
+		SWVersion:        softwareVersion(),
+		ConfigurationURL: configurationURL(cfg),
+		SuggestedArea:    values.expand(cfg.HASSSuggestedArea),
+		ViaDevice:        cfg.HASSViaDevice,
+	}
+}
+
+// softwareVersion returns the module version the detector was built from, or
+// the commit when it was built from a checkout.
+func softwareVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if revision != "" && modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// configurationURL returns the page to manage the detector on: the configured
+// URL, the crop editor, or else the camera. Credentials in IMAGE_URL are left
+// out, as the device page shows the link to every Home Assistant user.
+func configurationURL(cfg *config.Config) string {
+	if cfg.HASSConfigurationURL != "" {
+		return cfg.HASSConfigurationURL
+	}
+	if cfg.WebUIAddress != "" {
+		host, port, err := net.SplitHostPort(cfg.WebUIAddress)
+		if err != nil {
+			return ""
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			if host, err = os.Hostname(); err != nil {
+				return ""
+			}
+			host = strings.ToLower(host)
+		}
+		return "http://" + net.JoinHostPort(host, port)
+	}
+	u, err := url.Parse(cfg.ImageURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+}
@@ -0,0 +1,426 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	"dark-detector/internal/classify"
+	"dark-detector/internal/config"
+)
+
+// Keys of the additional entities published next to the lux sensor.
+const (
+	EntityStdDev         = "stddev"
+	EntityContrast       = "contrast"
+	EntityLightness      = "lightness"
+	EntityEV             = "ev"
+	EntityLogLux         = "log_lux"
+	EntityDark           = "dark"
+	EntityClassification = "classification"
+	EntityTrend          = "trend"
+	EntityIRMode         = "ir_mode"
+	EntityColorTemp      = "color_temperature"
+	EntitySharpness      = "sharpness"
+	EntityMotion         = "motion"
+	EntityNoise          = "noise"
+	EntityLuxScale       = "lux_scale"
+	EntityDarkThreshold  = "dark_threshold"
+	EntityCalibrateDay   = "calibrate_day"
+	EntityCalibrateNight = "calibrate_night"
+	EntityCrop           = "crop"
+	EntityDarkPixels     = "dark_pixels"
+	EntityLuxMin         = "lux_min"
+	EntityLuxMax         = "lux_max"
+	EntityLuxMean        = "lux_mean"
+	EntityImage          = "image"
+	EntityBrightness     = "brightness"
+	EntityLastError      = "last_error"
+	EntityInterval       = "interval"
+	EntityEnabled        = "enabled"
+	EntityCropPreset     = "crop_preset"
+	EntityEvent          = "event"
+	EntitySnapshot       = "snapshot"
+	EntityAnnotated      = "annotated"
+)
+
+// Actions that can be triggered by publishing any payload to
+// <topic>/<unique id>/<action>.
+const (
+	ActionPoll   = "poll"
+	ActionPause  = "pause"
+	ActionResume = "resume"
+)
+
+// diagnosticsKey is where the runtime stats are published, under the base topic.
+const diagnosticsKey = "diagnostics"
+
+// categoryDiagnostic is the entity category of entities describing the
+// detector itself rather than the light.
+const categoryDiagnostic = "diagnostic"
+
+// Binary sensor states
+const (
+	StateOn  = "ON"
+	StateOff = "OFF"
+)
+
+// Entity describes an additional Home Assistant entity published alongside
+// the primary lux sensor. Its state is published to <topic>/<unique id>/<key>.
+type Entity struct {
+	Key               string
+	Name              string
+	Component         string
+	DeviceClass       string
+	Icon              string
+	UnitOfMeasurement string
+	Options           []string
+	// Range of number entities, or the maximum length of text entities. Both
+	// accept new values on <state topic>/set.
+	Min  float64
+	Max  float64
+	Step float64
+	// Entities reading a field of a JSON payload shared with other entities
+	// set the key of its topic, instead of their own, and a value template.
+	StateKey       string
+	ValueTemplate  string
+	EntityCategory string
+}
+
+// measured reports whether the entity's state comes from the camera frames.
+// Only measured entities go unavailable while the feed is frozen and expire
+// without new readings.
+func (e Entity) measured() bool {
+	return (e.Component == "sensor" || e.Component == "binary_sensor") && e.EntityCategory != categoryDiagnostic
+}
+
+// stateKey returns the key of the topic the entity reads its state from.
+func (e Entity) stateKey() string {
+	if e.StateKey != "" {
+		return e.StateKey
+	}
+	return e.Key
+}
+
+var (
+	stdDevEntity = Entity{
+		Key:               EntityStdDev,
+		Name:              "Luminance Standard Deviation",
+		Component:         "sensor",
+		DeviceClass:       "illuminance",
+		UnitOfMeasurement: "lx",
+	}
+	contrastEntity = Entity{
+		Key:       EntityContrast,
+		Name:      "Contrast",
+		Component: "sensor",
+	}
+	lightnessEntity = Entity{
+		Key:               EntityLightness,
+		Name:              "Lightness",
+		Component:         "sensor",
+		UnitOfMeasurement: "L*",
+	}
+	luxScaleEntity = Entity{
+		Key:       EntityLuxScale,
+		Name:      "Lux Scale",
+		Component: "number",
+		Min:       1,
+		Max:       1000000,
+		Step:      1,
+	}
+	darkThresholdEntity = Entity{
+		Key:               EntityDarkThreshold,
+		Name:              "Dark Threshold",
+		Component:         "number",
+		UnitOfMeasurement: "lx",
+		Min:               0,
+		Max:               100000,
+		Step:              1,
+	}
+	// eventEntity fires the transitions between readings, its Options are
+	// the event types
+	eventEntity = Entity{
+		Key:       EntityEvent,
+		Name:      "Light Change",
+		Component: "event",
+		Options:   classify.ChangeEvents,
+	}
+	// refreshEntity is a button publishing to the poll action topic
+	refreshEntity = Entity{
+		Key:       ActionPoll,
+		Name:      "Refresh",
+		Component: "button",
+	}
+	// enabledEntity is ON while readings are taken, OFF while paused
+	enabledEntity = Entity{
+		Key:       EntityEnabled,
+		Name:      "Enabled",
+		Component: "switch",
+	}
+	intervalEntity = Entity{
+		Key:               EntityInterval,
+		Name:              "Interval",
+		Component:         "number",
+		DeviceClass:       "duration",
+		UnitOfMeasurement: "s",
+		Min:               1,
+		Max:               86400,
+		Step:              1,
+	}
+	calibrateDayEntity = Entity{
+		Key:               EntityCalibrateDay,
+		Name:              "Day Calibration Lux",
+		Component:         "number",
+		UnitOfMeasurement: "lx",
+		Min:               0,
+		Max:               200000,
+		Step:              0.01,
+	}
+	calibrateNightEntity = Entity{
+		Key:               EntityCalibrateNight,
+		Name:              "Night Calibration Lux",
+		Component:         "number",
+		UnitOfMeasurement: "lx",
+		Min:               0,
+		Max:               200000,
+		Step:              0.01,
+	}
+	cropEntity = Entity{
+		Key:       EntityCrop,
+		Name:      "Image Crop",
+		Component: "text",
+		Max:       255,
+	}
+	evEntity = Entity{
+		Key:               EntityEV,
+		Name:              "Exposure Value",
+		Component:         "sensor",
+		UnitOfMeasurement: "EV",
+	}
+	logLuxEntity = Entity{
+		Key:       EntityLogLux,
+		Name:      "Log Lux",
+		Component: "sensor",
+	}
+	trendEntity = Entity{
+		Key:               EntityTrend,
+		Name:              "Lux Trend",
+		Component:         "sensor",
+		UnitOfMeasurement: "lx/min",
+	}
+	darkPixelsEntity = Entity{
+		Key:               EntityDarkPixels,
+		Name:              "Dark Pixels",
+		Component:         "sensor",
+		UnitOfMeasurement: "%",
+	}
+	luxMinEntity = Entity{
+		Key:               EntityLuxMin,
+		Name:              "Lux Minimum",
+		Component:         "sensor",
+		DeviceClass:       "illuminance",
+		UnitOfMeasurement: "lx",
+	}
+	luxMaxEntity = Entity{
+		Key:               EntityLuxMax,
+		Name:              "Lux Maximum",
+		Component:         "sensor",
+		DeviceClass:       "illuminance",
+		UnitOfMeasurement: "lx",
+	}
+	luxMeanEntity = Entity{
+		Key:               EntityLuxMean,
+		Name:              "Lux Average",
+		Component:         "sensor",
+		DeviceClass:       "illuminance",
+		UnitOfMeasurement: "lx",
+	}
+	irModeEntity = Entity{
+		Key:       EntityIRMode,
+		Name:      "IR Mode",
+		Component: "binary_sensor",
+	}
+	colorTempEntity = Entity{
+		Key:               EntityColorTemp,
+		Name:              "Color Temperature",
+		Component:         "sensor",
+		UnitOfMeasurement: "K",
+	}
+	sharpnessEntity = Entity{
+		Key:       EntitySharpness,
+		Name:      "Sharpness",
+		Component: "sensor",
+	}
+	noiseEntity = Entity{
+		Key:       EntityNoise,
+		Name:      "Noise",
+		Component: "sensor",
+	}
+	motionEntity = Entity{
+		Key:         EntityMotion,
+		Name:        "Motion",
+		Component:   "binary_sensor",
+		DeviceClass: "motion",
+	}
+	imageEntity = Entity{
+		Key:            EntityImage,
+		Name:           "Measured Image",
+		Component:      "image",
+		EntityCategory: categoryDiagnostic,
+	}
+	snapshotEntity = Entity{
+		Key:            EntitySnapshot,
+		Name:           "Snapshot",
+		Component:      "camera",
+		EntityCategory: categoryDiagnostic,
+	}
+	annotatedEntity = Entity{
+		Key:            EntityAnnotated,
+		Name:           "Annotated Frame",
+		Component:      "image",
+		EntityCategory: categoryDiagnostic,
+	}
+	diagnosticEntities = []Entity{
+		newDiagnosticEntity("uptime", "Uptime", "duration", "s"),
+		newDiagnosticEntity("cycles", "Readings", "", ""),
+		newDiagnosticEntity("frame_age", "Frame Age", "duration", "s"),
+		newDiagnosticEntity("fetch_failures", "Fetch Failures", "", ""),
+		newDiagnosticEntity("decode_failures", "Decode Failures", "", ""),
+		newDiagnosticEntity("publish_failures", "Publish Failures", "", ""),
+	}
+	// lastErrorEntity is published on a topic of its own with
+	// LAST_ERROR_ENABLED, and read from the diagnostics otherwise.
+	lastErrorEntity = Entity{
+		Key:            EntityLastError,
+		Name:           "Last Error",
+		Component:      "sensor",
+		EntityCategory: categoryDiagnostic,
+	}
+	brightnessEntity = Entity{
+		Key:               EntityBrightness,
+		Name:              "Brightness",
+		Component:         "sensor",
+		UnitOfMeasurement: "%",
+	}
+)
+
+// RegionKey returns the entity key of the lux sensor for the named region.
+func RegionKey(name string) string {
+	return "region_" + name
+}
+
+// newRegionEntity creates the lux sensor for a region.
+func newRegionEntity(region config.Region) Entity {
+	name := strings.ReplaceAll(region.Name, "_", " ")
+	return Entity{
+		Key:               RegionKey(region.Name),
+		Name:              strings.ToUpper(name[:1]) + name[1:] + " Lux",
+		Component:         "sensor",
+		DeviceClass:       "illuminance",
+		UnitOfMeasurement: "lx",
+	}
+}
+
+// DeviceClassLight is the binary sensor device class whose ON state means
+// light was detected, the opposite of the dark sensor.
+const DeviceClassLight = "light"
+
+// newDarkEntity creates the dark binary sensor with the given device class.
+// With DeviceClassLight it reports light instead, and its state is inverted.
+func newDarkEntity(deviceClass string) Entity {
+	name := "Dark"
+	if deviceClass == DeviceClassLight {
+		name = "Light"
+	}
+	return Entity{
+		Key:         EntityDark,
+		Name:        name,
+		Component:   "binary_sensor",
+		DeviceClass: deviceClass,
+	}
+}
+
+// newClassificationEntity creates the enum sensor for the given band names.
+func newClassificationEntity(bands []config.Band) Entity {
+	options := make([]string, len(bands))
+	for i, band := range bands {
+		options[i] = band.Name
+	}
+	return Entity{
+		Key:         EntityClassification,
+		Name:        "Scene Phase",
+		Component:   "sensor",
+		DeviceClass: "enum",
+		Options:     options,
+	}
+}
+
+// newCropPresetEntity creates the select entity for the given crop presets.
+func newCropPresetEntity(presets []config.CropPreset) Entity {
+	options := make([]string, len(presets))
+	for i, preset := range presets {
+		options[i] = preset.Name
+	}
+	return Entity{
+		Key:       EntityCropPreset,
+		Name:      "Crop Preset",
+		Component: "select",
+		Options:   options,
+	}
+}
+
+// newDiagnosticEntity creates the sensor for a field of the diagnostics payload.
+func newDiagnosticEntity(field, name, deviceClass, unit string) Entity {
+	return Entity{
+		Key:               field,
+		Name:              name,
+		Component:         "sensor",
+		DeviceClass:       deviceClass,
+		UnitOfMeasurement: unit,
+		StateKey:          diagnosticsKey,
+		ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", field),
+		EntityCategory:    categoryDiagnostic,
+	}
+}
+
+// applyOverrides sets the icons and device classes configured for entities
+// in place of their defaults.
+func (p *Publisher) applyOverrides(cfg *config.Config) error {
+	for name, overrides := range map[string]map[string]string{
+		"HASS_ICONS":          cfg.HASSIcons,
+		"HASS_DEVICE_CLASSES": cfg.HASSDeviceClasses,
+	} {
+		for key := range overrides {
+			if key != config.OutputLux && !p.hasEntity(key) {
+				return fmt.Errorf("%s has unknown or disabled entity %q", name, key)
+			}
+		}
+	}
+
+	if icon, ok := cfg.HASSIcons[config.OutputLux]; ok {
+		p.luxIcon = icon
+	}
+	if deviceClass, ok := cfg.HASSDeviceClasses[config.OutputLux]; ok {
+		p.luxDeviceClass = deviceClass
+	}
+	for i := range p.entities {
+		entity := &p.entities[i]
+		if icon, ok := cfg.HASSIcons[entity.Key]; ok {
+			entity.Icon = icon
+		}
+		if deviceClass, ok := cfg.HASSDeviceClasses[entity.Key]; ok {
+			entity.DeviceClass = deviceClass
+		}
+	}
+	return nil
+}
+
+// hasEntity reports whether an entity with the given key is published.
+func (p *Publisher) hasEntity(key string) bool {
+	for _, entity := range p.entities {
+		if entity.Key == key {
+			return true
+		}
+	}
+	return false
+}
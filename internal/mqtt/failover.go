@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/url"
+	"time"
+)
+
+// openConnection dials a broker like the MQTT client does for tcp:// and
+// ssl:// URLs, and keeps the connection so it can be dropped to fail back to
+// the primary broker.
+func (p *Publisher) openConnection(ctx context.Context, broker *url.URL, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if broker.Scheme == "ssl" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", broker.Host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", broker.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	p.conn = conn
+	p.broker = broker.Host
+	return conn, nil
+}
+
+// connectedBroker returns the address of the broker the client last
+// connected to, empty with a single broker.
+func (p *Publisher) connectedBroker() string {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return p.broker
+}
+
+// failBack checks every interval whether the primary broker is reachable
+// while connected to another one, and drops the connection when it is. The
+// client reconnects on its own, trying the brokers in order, and messages
+// published in the meantime are sent once it is connected.
+func (p *Publisher) failBack(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		p.connMu.Lock()
+		conn, broker := p.conn, p.broker
+		p.connMu.Unlock()
+		if conn == nil || broker == p.primaryBroker || !p.client.IsConnectionOpen() {
+			continue
+		}
+
+		probe, err := net.DialTimeout("tcp", p.primaryBroker, p.connectTimeout)
+		if err != nil {
+			continue
+		}
+		probe.Close()
+		log.Printf("Primary MQTT broker %s is reachable again, failing back from %s", p.primaryBroker, broker)
+		conn.Close()
+	}
+}
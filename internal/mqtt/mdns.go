@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// mdnsTimeout is how long brokers get to answer the mDNS query.
+	mdnsTimeout = 5 * time.Second
+	mdnsAddress = "224.0.0.251:5353"
+)
+
+// Services brokers advertise themselves as over mDNS, e.g. the Mosquitto
+// add-on of Home Assistant OS.
+const (
+	mdnsService       = "_mqtt._tcp.local."
+	mdnsSecureService = "_secure-mqtt._tcp.local."
+)
+
+// discoverBroker finds a broker advertising itself over mDNS and returns its
+// URL, for when no MQTT_HOST is configured.
+func discoverBroker(tls bool) (string, error) {
+	scheme, service := "tcp", mdnsService
+	if tls {
+		scheme, service = "ssl", mdnsSecureService
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mdnsTimeout)
+	defer cancel()
+
+	host, err := lookupService(ctx, service)
+	if err != nil {
+		return "", fmt.Errorf("failed to discover MQTT broker over mDNS: %w", err)
+	}
+	return fmt.Sprintf("%s://%s", scheme, host), nil
+}
+
+// lookupService sends an mDNS query for service and returns the host:port of
+// the first instance that answers. The query comes from an ephemeral port, so
+// responders answer it directly rather than to the multicast group.
+func lookupService(ctx context.Context, service string) (string, error) {
+	name, err := dnsmessage.NewName(service)
+	if err != nil {
+		return "", err
+	}
+	query, err := (&dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return "", fmt.Errorf("failed to build query: %w", err)
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.WriteTo(query, group); err != nil {
+		return "", fmt.Errorf("failed to send query: %w", err)
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if isTimeout(err) {
+				return "", fmt.Errorf("no broker answered for %s", service)
+			}
+			return "", err
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil {
+			// Other devices answer with records we can't read, keep listening
+			continue
+		}
+		if host, ok := serviceHost(&msg, name); ok {
+			return host, nil
+		}
+	}
+}
+
+// serviceHost returns the host:port of the first instance of service in an
+// mDNS response, preferring the IPv4 address of its target over the name,
+// which the system resolver often can't resolve inside containers.
+func serviceHost(msg *dnsmessage.Message, service dnsmessage.Name) (string, bool) {
+	records := make([]dnsmessage.Resource, 0, len(msg.Answers)+len(msg.Additionals))
+	records = append(append(records, msg.Answers...), msg.Additionals...)
+
+	var instance string
+	for _, r := range records {
+		if ptr, ok := r.Body.(*dnsmessage.PTRResource); ok && strings.EqualFold(r.Header.Name.String(), service.String()) {
+			instance = ptr.PTR.String()
+			break
+		}
+	}
+	if instance == "" {
+		return "", false
+	}
+
+	var srv *dnsmessage.SRVResource
+	for _, r := range records {
+		if s, ok := r.Body.(*dnsmessage.SRVResource); ok && strings.EqualFold(r.Header.Name.String(), instance) {
+			srv = s
+			break
+		}
+	}
+	if srv == nil {
+		return "", false
+	}
+	port := strconv.Itoa(int(srv.Port))
+	for _, r := range records {
+		if a, ok := r.Body.(*dnsmessage.AResource); ok && strings.EqualFold(r.Header.Name.String(), srv.Target.String()) {
+			return net.JoinHostPort(net.IP(a.A[:]).String(), port), true
+		}
+	}
+	return net.JoinHostPort(strings.TrimSuffix(srv.Target.String(), "."), port), true
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
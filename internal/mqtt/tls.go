@@ -0,0 +1,41 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"dark-detector/internal/config"
+)
+
+// newTLSConfig builds the TLS settings for connecting to the broker from the
+// CA and client certificate files in the configuration.
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.MQTTTLSInsecure,
+	}
+
+	if cfg.MQTTCAFile != "" {
+		pem, err := os.ReadFile(cfg.MQTTCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MQTT CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in MQTT CA file %s", cfg.MQTTCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.MQTTClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.MQTTClientCertFile, cfg.MQTTClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MQTT client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
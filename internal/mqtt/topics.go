@@ -0,0 +1,49 @@
+package mqtt
+
+import (
+	"net/url"
+	"strings"
+)
+
+// topicValues holds the values of the placeholders in topic templates.
+type topicValues map[string]string
+
+// expand replaces the {placeholders} of a topic template.
+func (v topicValues) expand(template string) string {
+	pairs := make([]string, 0, len(v)*2)
+	for name, value := range v {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// with returns a copy of the values with more placeholders set.
+func (v topicValues) with(pairs ...string) topicValues {
+	values := make(topicValues, len(v)+len(pairs)/2)
+	for name, value := range v {
+		values[name] = value
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		values[pairs[i]] = pairs[i+1]
+	}
+	return values
+}
+
+// cameraName returns the host name of the image URL, used for the {camera}
+// placeholder.
+func cameraName(imageURL string) string {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// discoveryTopic returns the Home Assistant discovery topic of a component.
+func (p *Publisher) discoveryTopic(component, objectID string) string {
+	return p.topicValues.with(
+		"prefix", p.autoDiscoveryTopic,
+		"component", component,
+		"object_id", objectID,
+	).expand(p.discoveryTopicTemplate)
+}
@@ -0,0 +1,307 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dark-detector/internal/config"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v5Client speaks MQTT 5 through paho.golang in place of the MQTT 3 client.
+// It keeps the connection up on its own, like the MQTT 3 client, and adds
+// the expiry of messages that only MQTT 5 has. Message handlers are called
+// without a client.
+type v5Client struct {
+	config    autopaho.ClientConfig
+	expiry    map[string]uint32 // seconds the broker keeps the messages of a topic
+	manager   atomic.Pointer[autopaho.ConnectionManager]
+	connected atomic.Bool
+	routesMu  sync.Mutex
+	routes    map[string]mqtt.MessageHandler // by topic filter
+}
+
+// newV5Client creates an MQTT 5 client with the same options the MQTT 3
+// client gets, plus the session expiry and the expiry of lux states.
+func (p *Publisher) newV5Client(cfg *config.Config, clientID string, brokers []string, tlsConfig *tls.Config) (*v5Client, error) {
+	c := &v5Client{
+		expiry: make(map[string]uint32),
+		routes: make(map[string]mqtt.MessageHandler),
+	}
+	if cfg.MQTTMessageExpiry > 0 {
+		// Subscribers that come after the detector stopped don't get a stale reading
+		c.expiry[p.topic] = uint32(cfg.MQTTMessageExpiry)
+	}
+
+	urls := make([]*url.URL, len(brokers))
+	for i, broker := range brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MQTT broker %q: %w", broker, err)
+		}
+		urls[i] = u
+	}
+	retryInterval := time.Duration(cfg.MQTTConnectRetryInterval) * time.Second
+	maxInterval := time.Duration(cfg.MQTTMaxReconnectInterval) * time.Second
+
+	c.config = autopaho.ClientConfig{
+		ServerUrls:                    urls,
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     uint16(cfg.MQTTKeepAlive),
+		CleanStartOnInitialConnection: cfg.MQTTCleanSession,
+		SessionExpiryInterval:         uint32(cfg.MQTTSessionExpiry),
+		ConnectTimeout:                p.connectTimeout,
+		ReconnectBackoff: func(attempt int) time.Duration {
+			// The retry interval, doubling with every failed attempt
+			delay := time.Duration(0)
+			for i := 0; i < attempt && delay < maxInterval; i++ {
+				delay = max(retryInterval, 2*delay)
+			}
+			return min(delay, maxInterval)
+		},
+		ConnectUsername: cfg.MQTTUsername,
+		ConnectPassword: []byte(cfg.MQTTPassword),
+		WillMessage: &paho.WillMessage{
+			Topic:   p.willTopic(),
+			Payload: []byte(cfg.MQTTPayloadNotAvailable),
+			QoS:     cfg.MQTTAvailabilityQoS,
+			Retain:  cfg.MQTTAvailabilityRetain,
+		},
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			c.connected.Store(true)
+			go p.onConnect()
+		},
+		OnConnectError: func(err error) {
+			log.Printf("Failed to connect to MQTT broker, retrying: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:      clientID,
+			PacketTimeout: p.publishTimeout,
+			OnClientError: func(err error) {
+				if c.connected.Swap(false) {
+					p.onConnectionLost(err)
+				}
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				if c.connected.Swap(false) {
+					p.onConnectionLost(fmt.Errorf("disconnected by the broker: %s", d.Packet().Reason()))
+				}
+			},
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.route},
+		},
+	}
+	if p.primaryBroker != "" {
+		c.config.AttemptConnection = func(ctx context.Context, cfg autopaho.ClientConfig, broker *url.URL) (net.Conn, error) {
+			conn, err := p.openConnection(ctx, broker, cfg.ConnectTimeout, cfg.TlsCfg)
+			if err != nil {
+				return nil, err
+			}
+			// The client writes from several goroutines, which a TLS connection doesn't allow
+			return packets.NewThreadSafeConn(conn), nil
+		}
+	}
+	return c, nil
+}
+
+// Connect starts connecting to the brokers, retrying until one accepts the
+// connection. The token completes once connected.
+func (c *v5Client) Connect() mqtt.Token {
+	return newV5Token(func() error {
+		manager, err := autopaho.NewConnection(context.Background(), c.config)
+		if err != nil {
+			return err
+		}
+		c.manager.Store(manager)
+		return manager.AwaitConnection(context.Background())
+	})
+}
+
+// Disconnect closes the connection, waiting up to quiesce milliseconds for
+// the client to shut down.
+func (c *v5Client) Disconnect(quiesce uint) {
+	manager := c.manager.Load()
+	if manager == nil {
+		return
+	}
+	c.connected.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancel()
+	if err := manager.Disconnect(ctx); err != nil {
+		log.Printf("Failed to disconnect from MQTT broker: %v", err)
+	}
+}
+
+// IsConnectionOpen reports whether the client is connected to a broker.
+func (c *v5Client) IsConnectionOpen() bool {
+	return c.connected.Load()
+}
+
+// Publish sends a message, with the expiry of its topic if it has one. The
+// token completes once the broker acknowledged it.
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return newV5Token(func() error {
+		manager := c.manager.Load()
+		if manager == nil {
+			return autopaho.ConnectionDownError
+		}
+		publish := &paho.Publish{Topic: topic, QoS: qos, Retain: retained}
+		switch payload := payload.(type) {
+		case string:
+			publish.Payload = []byte(payload)
+		case []byte:
+			publish.Payload = payload
+		default:
+			return fmt.Errorf("unknown payload type %T", payload)
+		}
+		if expiry, ok := c.expiry[topic]; ok {
+			publish.Properties = &paho.PublishProperties{MessageExpiry: &expiry}
+		}
+		_, err := manager.Publish(context.Background(), publish)
+		return err
+	})
+}
+
+// Subscribe subscribes to a topic filter and calls callback with the messages
+// matching it, in a goroutine of their own.
+func (c *v5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return newV5Token(func() error {
+		manager := c.manager.Load()
+		if manager == nil {
+			return autopaho.ConnectionDownError
+		}
+		c.routesMu.Lock()
+		c.routes[topic] = callback
+		c.routesMu.Unlock()
+		_, err := manager.Subscribe(context.Background(), &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+		})
+		return err
+	})
+}
+
+// Unsubscribe ends the subscriptions to the topic filters.
+func (c *v5Client) Unsubscribe(topics ...string) mqtt.Token {
+	return newV5Token(func() error {
+		manager := c.manager.Load()
+		if manager == nil {
+			return autopaho.ConnectionDownError
+		}
+		c.routesMu.Lock()
+		for _, topic := range topics {
+			delete(c.routes, topic)
+		}
+		c.routesMu.Unlock()
+		_, err := manager.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+// route passes a received message to the callbacks of the topic filters it
+// matches.
+func (c *v5Client) route(received paho.PublishReceived) (bool, error) {
+	var callbacks []mqtt.MessageHandler
+	c.routesMu.Lock()
+	for filter, callback := range c.routes {
+		if topicMatches(filter, received.Packet.Topic) {
+			callbacks = append(callbacks, callback)
+		}
+	}
+	c.routesMu.Unlock()
+
+	for _, callback := range callbacks {
+		// Like the MQTT 3 client, which doesn't keep the order of messages either
+		go callback(nil, v5Message{publish: received.Packet})
+	}
+	return len(callbacks) > 0, nil
+}
+
+// topicMatches reports whether a topic matches a subscription filter, which
+// may hold + and # wildcards. Topics starting with $ only match filters that
+// spell out their first level.
+func topicMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// v5Message is a message received over MQTT 5.
+type v5Message struct {
+	publish *paho.Publish
+}
+
+func (m v5Message) Duplicate() bool   { return false }
+func (m v5Message) Qos() byte         { return m.publish.QoS }
+func (m v5Message) Retained() bool    { return m.publish.Retain }
+func (m v5Message) Topic() string     { return m.publish.Topic }
+func (m v5Message) MessageID() uint16 { return m.publish.PacketID }
+func (m v5Message) Payload() []byte   { return m.publish.Payload }
+func (m v5Message) Ack()              {}
+
+// v5Token completes when the operation it was returned for is done.
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+// newV5Token runs an operation in the background and returns its token.
+func newV5Token(operation func() error) *v5Token {
+	t := &v5Token{done: make(chan struct{})}
+	go func() {
+		t.err = operation()
+		close(t.done)
+	}()
+	return t
+}
+
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *v5Token) WaitTimeout(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *v5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Error returns why the operation failed, nil while it is running.
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
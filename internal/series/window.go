@@ -0,0 +1,101 @@
+package series
+
+import (
+	"math"
+	"time"
+)
+
+// Sample is a reading taken at a point in time.
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// Window keeps the readings taken within a sliding time window.
+type Window struct {
+	duration time.Duration
+	samples  []Sample
+}
+
+// NewWindow creates a window holding readings from the last duration.
+func NewWindow(duration time.Duration) *Window {
+	return &Window{duration: duration}
+}
+
+// Add records a reading and drops readings that fell out of the window.
+func (w *Window) Add(t time.Time, value float64) {
+	w.samples = append(w.samples, Sample{Time: t, Value: value})
+
+	cutoff := t.Add(-w.duration)
+	drop := 0
+	for drop < len(w.samples) && w.samples[drop].Time.Before(cutoff) {
+		drop++
+	}
+	w.samples = w.samples[drop:]
+}
+
+// Len returns the number of readings in the window.
+func (w *Window) Len() int {
+	return len(w.samples)
+}
+
+// Min returns the lowest reading in the window, or 0 when it is empty.
+func (w *Window) Min() float64 {
+	if len(w.samples) == 0 {
+		return 0
+	}
+	lowest := w.samples[0].Value
+	for _, s := range w.samples[1:] {
+		lowest = math.Min(lowest, s.Value)
+	}
+	return lowest
+}
+
+// Max returns the highest reading in the window, or 0 when it is empty.
+func (w *Window) Max() float64 {
+	if len(w.samples) == 0 {
+		return 0
+	}
+	highest := w.samples[0].Value
+	for _, s := range w.samples[1:] {
+		highest = math.Max(highest, s.Value)
+	}
+	return highest
+}
+
+// Mean returns the average of the readings in the window, or 0 when it is empty.
+func (w *Window) Mean() float64 {
+	if len(w.samples) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, s := range w.samples {
+		sum += s.Value
+	}
+	return sum / float64(len(w.samples))
+}
+
+// SlopePerMinute returns the least-squares rate of change of the readings per
+// minute, or 0 when there are too few readings to estimate it.
+func (w *Window) SlopePerMinute() float64 {
+	n := float64(len(w.samples))
+	if n < 2 {
+		return 0
+	}
+
+	origin := w.samples[0].Time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range w.samples {
+		x := s.Time.Sub(origin).Minutes()
+		sumX += x
+		sumY += s.Value
+		sumXY += x * s.Value
+		sumXX += x * x
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
@@ -0,0 +1,96 @@
+package solar
+
+import (
+	"math"
+	"time"
+)
+
+// Natural illuminance limits
+const (
+	moonlightLux      = 0.3    // a full moon, the brightest natural light at night
+	horizonLux        = 400    // a clear sky with the sun on the horizon
+	directSunlightLux = 130000 // additional illuminance of a clear sky with the sun overhead
+	julianUnixEpoch   = 2440587.5
+	julianJ2000       = 2451545.0
+	secondsPerDay     = 86400
+)
+
+// twilight is the clear-sky illuminance, in lux, with the sun below the horizon.
+// Values in between are interpolated logarithmically.
+var twilight = []struct {
+	elevation float64
+	lux       float64
+}{
+	{-8, moonlightLux},
+	{-6, 3.4}, // end of civil twilight
+	{0, horizonLux},
+}
+
+// Elevation returns the elevation of the sun above the horizon in degrees at
+// the given time and position, accurate to about a degree.
+func Elevation(t time.Time, latitude, longitude float64) float64 {
+	// Days since the J2000 epoch
+	n := float64(t.UnixNano())/1e9/secondsPerDay + julianUnixEpoch - julianJ2000
+
+	// Ecliptic coordinates of the sun
+	meanLongitude := math.Mod(280.460+0.9856474*n, 360)
+	meanAnomaly := radians(357.528 + 0.9856003*n)
+	eclipticLongitude := radians(meanLongitude + 1.915*math.Sin(meanAnomaly) + 0.020*math.Sin(2*meanAnomaly))
+	obliquity := radians(23.439 - 0.0000004*n)
+
+	// Equatorial coordinates
+	rightAscension := math.Atan2(math.Cos(obliquity)*math.Sin(eclipticLongitude), math.Cos(eclipticLongitude))
+	declination := math.Asin(math.Sin(obliquity) * math.Sin(eclipticLongitude))
+
+	// Local hour angle from the sidereal time
+	siderealHours := math.Mod(18.697374558+24.06570982441908*n, 24)
+	hourAngle := radians(siderealHours*15+longitude) - rightAscension
+
+	lat := radians(latitude)
+	elevation := math.Asin(math.Sin(lat)*math.Sin(declination) + math.Cos(lat)*math.Cos(declination)*math.Cos(hourAngle))
+	return elevation * 180 / math.Pi
+}
+
+// MaxIlluminance returns the highest natural illuminance, in lux, expected
+// under a clear sky with the sun at the given elevation in degrees.
+func MaxIlluminance(elevation float64) float64 {
+	if elevation >= 0 {
+		return horizonLux + directSunlightLux*math.Sin(radians(elevation))
+	}
+	if elevation <= twilight[0].elevation {
+		return moonlightLux
+	}
+	for i := 1; i < len(twilight); i++ {
+		lo, hi := twilight[i-1], twilight[i]
+		if elevation <= hi.elevation {
+			f := (elevation - lo.elevation) / (hi.elevation - lo.elevation)
+			return math.Exp(math.Log(lo.lux) + f*(math.Log(hi.lux)-math.Log(lo.lux)))
+		}
+	}
+	return horizonLux
+}
+
+// Check flags readings brighter than the sun position allows, which usually
+// means a floodlight, headlights or an IR illuminator is skewing the image.
+type Check struct {
+	latitude  float64
+	longitude float64
+	margin    float64
+}
+
+// NewCheck creates a check for the given position. margin is the illuminance,
+// in lux, allowed above the natural maximum to account for artificial lighting.
+func NewCheck(latitude, longitude, margin float64) *Check {
+	return &Check{latitude: latitude, longitude: longitude, margin: margin}
+}
+
+// Limit returns the solar elevation at the given time and the highest reading
+// considered plausible.
+func (c *Check) Limit(now time.Time) (elevation, limit float64) {
+	elevation = Elevation(now, c.latitude, c.longitude)
+	return elevation, MaxIlluminance(elevation) + c.margin
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
@@ -0,0 +1,84 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"dark-detector/internal/calibration"
+	"dark-detector/internal/config"
+)
+
+// State is what the detector learned while running, saved so a restart
+// doesn't reset smoothing and auto-calibration.
+type State struct {
+	SavedAt time.Time `json:"saved_at"`
+	// Lux is the last published lux, nil before the first reading
+	Lux *int `json:"lux,omitempty"`
+	// Calibration is the curve fitted by auto-calibration, nil until one is fitted
+	Calibration *calibration.File `json:"calibration,omitempty"`
+	// ReferenceSamples are the samples collected by auto-calibration
+	ReferenceSamples []config.CalibrationPoint `json:"reference_samples,omitempty"`
+	// Settings changed from Home Assistant
+	Settings Settings `json:"settings"`
+	// DiscoveryTopics are where the discovery configs were last published,
+	// to remove the ones a new configuration no longer uses
+	DiscoveryTopics []string `json:"discovery_topics,omitempty"`
+}
+
+// Settings are values changed at runtime that take precedence over the
+// configuration. Each is nil until it is changed.
+type Settings struct {
+	LuxScale      *float64      `json:"lux_scale,omitempty"`
+	DarkThreshold *float64      `json:"dark_threshold,omitempty"`
+	ImageCrop     *config.Crops `json:"image_crop,omitempty"` // empty when the crop was removed
+	Paused        *bool         `json:"paused,omitempty"`
+	Interval      *int          `json:"interval,omitempty"` // seconds between readings
+}
+
+// Load reads the state file. It returns an empty state when the file doesn't exist.
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	return &s, nil
+}
+
+// Save writes the state file. The state is written to a temporary file first
+// and renamed over the old one, so a crash never leaves a partial file behind.
+func (s *State) Save(path string) error {
+	s.SavedAt = time.Now()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
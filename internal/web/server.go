@@ -0,0 +1,153 @@
+package web
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"dark-detector/internal/config"
+)
+
+// maxCropSize bounds the size of a submitted crop in bytes.
+const maxCropSize = 4096
+
+//go:embed index.html
+var indexPage []byte
+
+// Server serves a page that shows the latest frame and lets the crop be
+// drawn on it with the mouse.
+type Server struct {
+	server    *http.Server
+	frame     func() image.Image
+	preview   func() image.Image
+	setCrop   func(crops config.Crops)
+	mu        sync.Mutex
+	crop      string
+	connected bool // whether the detector is connected to the MQTT broker
+}
+
+// NewServer creates a server listening on addr. frame returns the latest
+// downloaded frame and preview the part of it that was measured, both nil
+// before the first one, and setCrop applies a crop submitted from the page.
+func NewServer(addr string, frame, preview func() image.Image, setCrop func(crops config.Crops)) *Server {
+	s := &Server{frame: frame, preview: preview, setCrop: setCrop}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /frame.jpg", s.handleFrame)
+	mux.HandleFunc("GET /preview.jpg", s.handlePreview)
+	mux.HandleFunc("GET /crop", s.handleGetCrop)
+	mux.HandleFunc("POST /crop", s.handleSetCrop)
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	s.server = &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return s
+}
+
+// Start listens on the address and serves requests in the background.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for web UI: %w", err)
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Web UI stopped: %v", err)
+		}
+	}()
+	log.Printf("Serving web UI on %s", listener.Addr())
+	return nil
+}
+
+// Shutdown stops the server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// SetCrop updates the crop shown on the page.
+func (s *Server) SetCrop(crops config.Crops) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.crop = crops.String()
+}
+
+// SetConnected updates the MQTT connection state reported by the health check.
+func (s *Server) SetConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+}
+
+// handleHealth reports whether the detector is connected to the MQTT broker,
+// for container health checks.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	connected := s.connected
+	s.mu.Unlock()
+	if !connected {
+		http.Error(w, "not connected to MQTT broker", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(indexPage)
+}
+
+func (s *Server) handleFrame(w http.ResponseWriter, r *http.Request) {
+	writeJPEG(w, s.frame())
+}
+
+func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	writeJPEG(w, s.preview())
+}
+
+// writeJPEG responds with the image, or an error when no frame has been
+// downloaded yet.
+func writeJPEG(w http.ResponseWriter, img image.Image) {
+	if img == nil {
+		http.Error(w, "no frame has been downloaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := jpeg.Encode(w, img, nil); err != nil {
+		log.Printf("Failed to encode image for web UI: %v", err)
+	}
+}
+
+func (s *Server) handleGetCrop(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	crop := s.crop
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, crop)
+}
+
+func (s *Server) handleSetCrop(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCropSize))
+	if err != nil {
+		http.Error(w, "failed to read crop", http.StatusBadRequest)
+		return
+	}
+
+	// An empty crop measures the whole frame
+	crops := config.Crops{}
+	if value := strings.TrimSpace(string(body)); value != "" {
+		if crops, err = config.ParseCrops(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.setCrop(crops)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,14 +3,24 @@ package main
 import (
 	"context"
 	"log"
+	"math"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
+	_ "time/tzdata" // local time for schedules in minimal containers, set with TZ
 
+	"dark-detector/internal/calibration"
+	"dark-detector/internal/classify"
 	"dark-detector/internal/config"
+	"dark-detector/internal/filter"
 	"dark-detector/internal/image"
 	"dark-detector/internal/mqtt"
+	"dark-detector/internal/series"
+	"dark-detector/internal/solar"
+	"dark-detector/internal/state"
+	"dark-detector/internal/web"
 )
 
 func main() {
@@ -28,17 +38,198 @@ func main() {
 		log.Fatalf("Failed to get config: %v", err)
 	}
 
-	processor := image.NewProcessor(cfg)
-	publisher := mqtt.NewPublisher(cfg)
+	if len(os.Args) > 1 && os.Args[1] == "calibrate" {
+		if err := runCalibrate(ctx, cfg, os.Args[2:]); err != nil {
+			log.Fatalf("Calibration failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "profile" {
+		if err := runProfile(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("Profile export failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "remove" {
+		if err := runRemove(ctx, cfg); err != nil {
+			log.Fatalf("Removing the entities failed: %v", err)
+		}
+		return
+	}
+
+	processor, err := image.NewProcessor(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create image processor: %v", err)
+	}
+	smoother, err := filter.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create smoothing filter: %v", err)
+	}
+	publisher, err := mqtt.NewPublisher(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create MQTT publisher: %v", err)
+	}
+	interval := time.Duration(cfg.Interval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	d := &detector{
+		processor:    processor,
+		publisher:    publisher,
+		smoother:     smoother,
+		rawAttribute: cfg.SmoothingRawAttribute,
+		commands:     make(chan command, commandQueueSize),
+		started:      time.Now(),
+		ticker:       ticker,
+		expireCycles: cfg.ExpireAfterCycles,
+		cropPresets:  cfg.CropPresets,
+		snapshotWait: time.Duration(cfg.CameraEntityInterval) * time.Second,
+		annotateWait: time.Duration(cfg.AnnotatedEntityInterval) * time.Second,
+	}
+	if cfg.MaxStep > 0 {
+		d.slewLimit = filter.NewSlewLimit(cfg.MaxStep)
+	}
+	if cfg.DeadBand > 0 || cfg.DeadBandPercent > 0 {
+		d.deadBand = filter.NewDeadBand(cfg.DeadBand, cfg.DeadBandPercent)
+	}
+	d.setInterval(interval)
+	if cfg.DarkEnabled {
+		d.dark = classify.NewDark(cfg.DarkThresholdOn, cfg.DarkThresholdOff, time.Duration(cfg.DarkMinDwell)*time.Second)
+		d.reportLight = cfg.DarkDeviceClass == mqtt.DeviceClassLight
+	}
+	if cfg.ClassificationEnabled {
+		d.phase = classify.NewPhase(cfg.ClassificationBands)
+	}
+	if cfg.FrozenDetectionEnabled {
+		d.frozen = classify.NewFrozen(cfg.FrozenHashDistance, cfg.FrozenFrameCycles)
+	}
+	if cfg.EventsEnabled {
+		d.change = classify.NewChange(cfg.EventChangePercent, cfg.EventMinChange)
+	}
+	if cfg.TrendEnabled {
+		d.trend = series.NewWindow(time.Duration(cfg.TrendWindow) * time.Second)
+	}
+	if cfg.AggregateEnabled {
+		d.aggregate = series.NewWindow(time.Duration(cfg.AggregateWindow) * time.Second)
+	}
+	if cfg.ReferenceTopic != "" {
+		auto := calibration.NewAuto(cfg.ReferenceMinSamples)
+		err := publisher.Subscribe(ctx, cfg.ReferenceTopic, func(payload []byte) {
+			lux, err := calibration.ParseReference(payload, cfg.ReferenceKey)
+			if err != nil {
+				log.Printf("Ignoring reference reading: %v", err)
+				return
+			}
+			auto.SetReference(lux, time.Now())
+		})
+		if err != nil {
+			log.Fatalf("Failed to subscribe to reference sensor: %v", err)
+		}
+		d.calibrator = auto
+	}
+	if cfg.DiagnosticsEnabled {
+		d.diagnostics = newDiagnostics(cfg.ImageURL)
+	}
+	if cfg.SolarCheckEnabled {
+		d.solar = solar.NewCheck(cfg.Latitude, cfg.Longitude, cfg.SolarLuxMargin)
+		d.solarClamp = cfg.SolarClampEnabled
+	}
+	if cfg.CalibrationEntitiesEnabled {
+		if cfg.CalibrationFile != "" {
+			f, err := calibration.LoadFile(cfg.CalibrationFile)
+			if err != nil {
+				log.Fatalf("Failed to load calibration file: %v", err)
+			}
+			if f != nil {
+				d.twoPoint = f.TwoPoint
+			}
+			d.twoPointFile = cfg.CalibrationFile
+		}
+		if err := d.subscribeCalibrationCommands(ctx); err != nil {
+			log.Fatalf("Failed to subscribe to calibration commands: %v", err)
+		}
+	}
+	if err := d.subscribeThresholdCommand(ctx); err != nil {
+		log.Fatalf("Failed to subscribe to threshold command: %v", err)
+	}
+	if err := d.subscribeCropPresetCommand(ctx, cfg.CropPresets); err != nil {
+		log.Fatalf("Failed to subscribe to crop preset command: %v", err)
+	}
+	if err := d.subscribeIntervalCommand(ctx); err != nil {
+		log.Fatalf("Failed to subscribe to interval command: %v", err)
+	}
+	if cfg.ImageTopic != "" {
+		// Readings are taken as images arrive instead
+		ticker.Stop()
+		d.ticker = nil
+		if err := d.subscribeImageTopic(ctx, cfg.ImageTopic); err != nil {
+			log.Fatalf("Failed to subscribe to image topic: %v", err)
+		}
+	} else if err := d.subscribePollCommand(ctx); err != nil {
+		log.Fatalf("Failed to subscribe to poll command: %v", err)
+	}
+	if err := d.subscribePauseCommands(ctx); err != nil {
+		log.Fatalf("Failed to subscribe to pause commands: %v", err)
+	}
+	if cfg.StateFile != "" {
+		s, err := state.Load(cfg.StateFile)
+		if err != nil {
+			log.Fatalf("Failed to load state: %v", err)
+		}
+		d.stateFile = cfg.StateFile
+		d.restoreState(s)
+	}
+
+	if cfg.WebUIAddress != "" {
+		d.webUI = web.NewServer(cfg.WebUIAddress, processor.LastFrame, processor.Preview, func(crops config.Crops) {
+			d.queueCommand("crop", d.setCrop(crops))
+		})
+		d.webUI.SetCrop(processor.Crop())
+		if err := d.webUI.Start(); err != nil {
+			log.Fatalf("Failed to start web UI: %v", err)
+		}
+		defer d.webUI.Shutdown(context.Background())
+	}
+
+	publisher.OnConnectionChange(func(connected bool) {
+		if d.webUI != nil {
+			d.webUI.SetConnected(connected)
+		}
+	})
+	publisher.OnHomeAssistantOnline(func() {
+		d.queueCommand("republish", func(ctx context.Context) error {
+			return publisher.RepublishStates(ctx)
+		})
+	})
 	if err := publisher.Connect(ctx); err != nil {
 		log.Fatalf("Failed to connect to MQTT broker: %v", err)
 	}
 	defer publisher.Disconnect()
-	ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Second)
-	defer ticker.Stop()
+	if cfg.HASSAutoDiscoveryEnabled && d.stateFile != "" {
+		if err := d.removeStaleDiscovery(ctx); err != nil {
+			log.Printf("Failed to remove discovery configs of a previous configuration: %v", err)
+		}
+	}
+	// A paused detector publishes no readings for the switch state to go with
+	if err := publisher.PublishDiscovery(ctx); err != nil {
+		log.Fatalf("Failed to publish discovery config: %v", err)
+	}
+	if err := publisher.PublishState(ctx, mqtt.EntityEnabled, formatBool(!d.paused)); err != nil {
+		log.Fatalf("Failed to publish switch state: %v", err)
+	}
+	if cfg.MQTTStateRestoreEnabled && d.lastLux == nil {
+		if err := d.restoreRetainedState(ctx); err != nil {
+			log.Printf("Failed to restore retained state: %v", err)
+		}
+	}
+
+	if cfg.DiagnosticsInterval > 0 {
+		go d.runDiagnostics(ctx, time.Duration(cfg.DiagnosticsInterval)*time.Second)
+	}
 
 	// Start processing in background
-	go runProcessingLoop(ctx, ticker, processor, publisher, errChan)
+	go runProcessingLoop(ctx, ticker, d, errChan)
 
 	// Handle shutdown gracefully
 	select {
@@ -53,11 +244,56 @@ func main() {
 	}
 }
 
+// detector measures frames and publishes the resulting readings.
+type detector struct {
+	processor    *image.Processor
+	publisher    *mqtt.Publisher
+	smoother     filter.Filter
+	rawAttribute bool              // expose the unsmoothed lux as an attribute
+	slewLimit    *filter.SlewLimit // nil unless a maximum step is configured
+	deadBand     *filter.DeadBand  // nil unless a dead band is configured
+	ticker       *time.Ticker      // nil when readings are taken as images arrive
+	lastImage    []byte            // latest image that arrived, nil before one does
+	interval     time.Duration     // time between readings
+	expireCycles int               // intervals until the states expire, 0 when they don't
+	refreshAfter time.Duration     // republish an unchanged lux before it expires, 0 when states don't expire
+	lastPublish  time.Time         // when the lux state was last published
+	dark         *classify.Dark    // nil unless dark detection is enabled
+	reportLight  bool              // publish the dark sensor ON when it's light
+	phase        *classify.Phase   // nil unless classification is enabled
+	trend        *series.Window    // nil unless the trend sensor is enabled
+	aggregate    *series.Window    // nil unless the min/max/average sensors are enabled
+	frozen       *classify.Frozen  // nil unless frozen feed detection is enabled
+	change       *classify.Change  // nil unless the event entity is enabled
+	feedFrozen   bool
+	calibrator   *calibration.Auto     // nil unless auto-calibration is enabled
+	solar        *solar.Check          // nil unless the sun position check is enabled
+	solarClamp   bool                  // clamp implausible readings to the solar limit
+	stateFile    string                // empty unless state is persisted
+	twoPointFile string                // where two-point readings are saved, may be empty
+	twoPoint     *calibration.TwoPoint // two-point calibration readings, nil until one is taken
+	discovered   []string              // where the discovery configs were last published, from the state file
+	cropPresets  []config.CropPreset   // crops that can be selected from Home Assistant
+	settings     state.Settings        // settings changed from Home Assistant
+	commands     chan command          // run between readings by the processing loop
+	lastLux      *int                  // last published lux, nil before the first reading
+	webUI        *web.Server           // nil unless the web UI is enabled
+	snapshotWait time.Duration         // least time between snapshots of the camera entity
+	lastSnapshot time.Time             // when the last snapshot was published
+	annotateWait time.Duration         // least time between frames of the annotated image entity
+	annotatedAt  time.Time             // when the last annotated frame was published
+	diagnostics  *diagnostics          // nil unless diagnostic attributes are enabled
+	paused       bool                  // skip readings until resumed
+	started      time.Time             // when the detector started
+	cycles       int                   // readings published since the start
+	frameAge     float64               // seconds between taking the last frame and publishing its reading
+	lastError    string                // why the last reading was skipped, empty before one is
+}
+
 func runProcessingLoop(
 	ctx context.Context,
 	ticker *time.Ticker,
-	processor *image.Processor,
-	publisher *mqtt.Publisher,
+	d *detector,
 	errChan chan<- error,
 ) {
 	for {
@@ -65,15 +301,231 @@ func runProcessingLoop(
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			lux, err := processor.Process(ctx)
-			if err != nil {
+			if d.paused {
+				continue
+			}
+			if err := d.processAndPublish(ctx); err != nil {
 				errChan <- err
 				return
 			}
-			if err := publisher.PublishLux(ctx, lux); err != nil {
+		case command := <-d.commands:
+			if err := command(ctx); err != nil {
 				errChan <- err
 				return
 			}
 		}
 	}
 }
+
+// processAndPublish takes a single measurement and publishes every enabled reading.
+func (d *detector) processAndPublish(ctx context.Context) error {
+	result, err := d.processor.Process(ctx)
+	if err := d.publisher.SetCameraAvailable(ctx, err == nil); err != nil {
+		return err
+	}
+	if err != nil {
+		if d.refreshAfter > 0 {
+			// Home Assistant lets the states expire rather than show an old reading
+			log.Printf("Skipping reading: %v", err)
+			return d.recordError(ctx, err)
+		}
+		return err
+	}
+	return d.publishResult(ctx, result)
+}
+
+// publishResult publishes every enabled reading of a measured frame.
+func (d *detector) publishResult(ctx context.Context, result *image.Result) error {
+	processor, publisher := d.processor, d.publisher
+
+	if result.Blank {
+		log.Println("Skipping blank or obstructed frame")
+		if d.diagnostics != nil {
+			d.diagnostics.blankFrames++
+		}
+		return nil
+	}
+	if d.frozen != nil {
+		if frozen := d.frozen.Update(result.Hash); frozen != d.feedFrozen {
+			d.feedFrozen = frozen
+			if frozen {
+				log.Println("Camera feed appears frozen, marking sensor unavailable")
+			} else {
+				log.Println("Camera feed recovered, marking sensor available")
+			}
+			if err := publisher.SetAvailable(ctx, !frozen); err != nil {
+				return err
+			}
+		}
+		if d.feedFrozen {
+			return nil
+		}
+	}
+	if d.calibrator != nil && !result.IRMode {
+		if curve := d.calibrator.Add(result.Brightness, time.Now()); curve != nil {
+			log.Printf("Fitted calibration curve to %d reference samples", len(d.calibrator.Samples()))
+			processor.SetCurve(curve)
+		}
+	}
+	attributes := make(map[string]interface{})
+	if d.rawAttribute {
+		attributes["raw_lux"] = result.Lux
+	}
+	if d.solar != nil {
+		elevation, limit := d.solar.Limit(time.Now())
+		plausibility := "plausible"
+		if float64(result.Lux) > limit {
+			plausibility = "implausible"
+			log.Printf("Reading of %d lx is implausible at a solar elevation of %.1f°", result.Lux, elevation)
+			if d.solarClamp {
+				result.Lux = int(limit)
+			}
+		}
+		attributes["plausibility"] = plausibility
+		attributes["solar_elevation"] = math.Round(elevation*10) / 10
+	}
+	if d.change != nil {
+		// Smoothing would spread a sudden change over several readings
+		for _, event := range d.change.Update(float64(result.Lux), result.IRMode) {
+			log.Printf("Light change: %s from %.0f to %.0f lx", event.Type, event.FromLux, event.ToLux)
+			payload := mqtt.EventPayload{EventType: event.Type, FromLux: int(event.FromLux), ToLux: int(event.ToLux)}
+			if err := publisher.PublishEvent(ctx, mqtt.EntityEvent, payload); err != nil {
+				return err
+			}
+		}
+	}
+	smoothed := d.smoother.Update(float64(result.Lux))
+	if d.slewLimit != nil {
+		smoothed = d.slewLimit.Update(smoothed)
+	}
+	lux := int(smoothed)
+	d.lastLux = &lux
+	now := time.Now()
+	d.frameAge = math.Round(now.Sub(result.FrameTime).Seconds()*10) / 10
+	var classification string
+	if d.phase != nil {
+		classification = d.phase.Classify(float64(lux))
+	}
+	refresh := d.refreshAfter > 0 && now.Sub(d.lastPublish) >= d.refreshAfter
+	if d.deadBand == nil || d.deadBand.Exceeded(float64(lux)) || refresh {
+		state := mqtt.StatePayload{
+			Lux:            lux,
+			Brightness:     result.Brightness,
+			Timestamp:      now,
+			FrameAge:       d.frameAge,
+			Regions:        result.Regions,
+			Classification: classification,
+		}
+		if err := publisher.PublishLux(ctx, state); err != nil {
+			return err
+		}
+		d.lastPublish = now
+	} else if err := publisher.PublishDiscovery(ctx); err != nil {
+		return err
+	}
+	if result.DominantColor != "" {
+		attributes["dominant_color"] = result.DominantColor
+	}
+	if d.diagnostics != nil {
+		d.diagnostics.addAttributes(attributes, d, result)
+	}
+	if err := publisher.PublishAttributes(ctx, attributes); err != nil {
+		return err
+	}
+	states := map[string]string{
+		mqtt.EntityLightness:  formatFloat(result.Lightness),
+		mqtt.EntityBrightness: formatFloat(result.Brightness * 100),
+		mqtt.EntityEV:         formatFloat(image.ExposureValue(float64(lux))),
+		mqtt.EntityLogLux:     formatFloat(image.LogLux(float64(lux))),
+		mqtt.EntityIRMode:     formatBool(result.IRMode),
+		mqtt.EntitySharpness:  formatFloat(result.Sharpness),
+		mqtt.EntityMotion:     formatBool(result.Motion),
+		mqtt.EntityNoise:      formatFloat(result.Noise),
+		mqtt.EntityDarkPixels: formatFloat(result.DarkPercent),
+	}
+	if d.dark != nil {
+		states[mqtt.EntityDark] = formatBool(d.dark.Update(float64(lux), now) != d.reportLight)
+	}
+	if d.trend != nil {
+		d.trend.Add(now, float64(lux))
+		states[mqtt.EntityTrend] = formatFloat(d.trend.SlopePerMinute())
+	}
+	if d.aggregate != nil {
+		d.aggregate.Add(now, float64(lux))
+		states[mqtt.EntityLuxMin] = strconv.Itoa(int(d.aggregate.Min()))
+		states[mqtt.EntityLuxMax] = strconv.Itoa(int(d.aggregate.Max()))
+		states[mqtt.EntityLuxMean] = strconv.Itoa(int(d.aggregate.Mean()))
+	}
+	if d.phase != nil {
+		states[mqtt.EntityClassification] = classification
+	}
+	if result.ColorTemperature > 0 {
+		states[mqtt.EntityColorTemp] = strconv.Itoa(int(result.ColorTemperature))
+	}
+	for name, regionLux := range result.Regions {
+		states[mqtt.RegionKey(name)] = strconv.Itoa(regionLux)
+	}
+	if linear, ok := processor.Curve().(calibration.Linear); ok {
+		states[mqtt.EntityLuxScale] = formatFloat(linear.Scale)
+	}
+	states[mqtt.EntityCrop] = processor.Crop().String()
+	if preset := d.cropPreset(); preset != "" {
+		states[mqtt.EntityCropPreset] = preset
+	}
+	if d.twoPoint != nil && d.twoPoint.Day != nil {
+		states[mqtt.EntityCalibrateDay] = formatFloat(d.twoPoint.Day.Lux)
+	}
+	if d.twoPoint != nil && d.twoPoint.Night != nil {
+		states[mqtt.EntityCalibrateNight] = formatFloat(d.twoPoint.Night.Lux)
+	}
+	states[mqtt.EntityInterval] = strconv.Itoa(int(d.interval / time.Second))
+	if d.dark != nil {
+		on, _ := d.dark.Thresholds()
+		states[mqtt.EntityDarkThreshold] = formatFloat(on)
+	}
+	if result.Stats != nil {
+		states[mqtt.EntityStdDev] = formatFloat(result.Stats.StdDev)
+		states[mqtt.EntityContrast] = formatFloat(result.Stats.Contrast)
+	}
+	if err := publisher.PublishStates(ctx, states); err != nil {
+		return err
+	}
+	if err := publisher.PublishImage(ctx, mqtt.EntityImage, processor.Preview); err != nil {
+		return err
+	}
+	if now.Sub(d.lastSnapshot) >= d.snapshotWait {
+		if err := publisher.PublishImage(ctx, mqtt.EntitySnapshot, processor.LastFrame); err != nil {
+			return err
+		}
+		d.lastSnapshot = now
+	}
+	if now.Sub(d.annotatedAt) >= d.annotateWait {
+		if err := publisher.PublishImage(ctx, mqtt.EntityAnnotated, processor.Annotated); err != nil {
+			return err
+		}
+		d.annotatedAt = now
+	}
+	if result.Histogram != nil {
+		if err := publisher.PublishHistogram(ctx, result.Histogram); err != nil {
+			return err
+		}
+	}
+	if d.stateFile != "" {
+		d.saveState()
+	}
+	d.cycles++
+	return nil
+}
+
+// formatBool formats a binary sensor state.
+func formatBool(value bool) string {
+	if value {
+		return mqtt.StateOn
+	}
+	return mqtt.StateOff
+}
+
+// formatFloat formats a reading with a fixed precision for publishing.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"dark-detector/internal/calibration"
+	"dark-detector/internal/config"
+	"dark-detector/internal/state"
+)
+
+// runProfile exports the calibration in use as a named profile, which other
+// instances import by setting CALIBRATION_PROFILE to the written file.
+func runProfile(cfg *config.Config, args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return fmt.Errorf("usage: profile export -name <name> [-output <file>]")
+	}
+	flags := flag.NewFlagSet("profile export", flag.ContinueOnError)
+	name := flags.String("name", cfg.HASSName, "name of the profile")
+	output := flags.String("output", "profile.json", "profile file to write")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	profile := config.NewProfile(*name, cfg)
+
+	// The calibration file and settings changed from Home Assistant take
+	// precedence over the environment, as they do while running
+	if cfg.CalibrationFile != "" {
+		f, err := calibration.LoadFile(cfg.CalibrationFile)
+		if err != nil {
+			return err
+		}
+		if f != nil && f.Curve != "" {
+			profile.Curve, profile.Table, profile.Coefficients = f.Curve, f.Table, f.Coefficients
+			if f.Scale > 0 {
+				profile.LuxScale = f.Scale
+			}
+		}
+	}
+	if cfg.StateFile != "" {
+		s, err := state.Load(cfg.StateFile)
+		if err != nil {
+			return err
+		}
+		if s.Settings.LuxScale != nil {
+			profile.Curve, profile.LuxScale = config.CurveLinear, *s.Settings.LuxScale
+			profile.Table, profile.Coefficients = nil, nil
+		}
+		if s.Calibration != nil && cfg.ReferenceTopic != "" {
+			// Auto-calibration replaces the curve once it has fitted one
+			profile.Curve, profile.Table = s.Calibration.Curve, s.Calibration.Table
+			profile.Coefficients = nil
+		}
+		if s.Settings.ImageCrop != nil {
+			profile.Crop = *s.Settings.ImageCrop
+		}
+		if s.Settings.DarkThreshold != nil {
+			profile.DarkThresholdOff += *s.Settings.DarkThreshold - profile.DarkThresholdOn
+			profile.DarkThresholdOn = *s.Settings.DarkThreshold
+		}
+	}
+
+	// Check the profile imports before writing it
+	if err := profile.Apply(&config.Config{}); err != nil {
+		return err
+	}
+	if err := profile.Save(*output); err != nil {
+		return err
+	}
+	fmt.Printf("Saved profile %q to %s, set CALIBRATION_PROFILE to import it\n", profile.Name, *output)
+	return nil
+}
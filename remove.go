@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"dark-detector/internal/config"
+	"dark-detector/internal/mqtt"
+)
+
+// runRemove removes the entities of the detector from Home Assistant by
+// clearing their discovery configs, e.g. when decommissioning a camera.
+func runRemove(ctx context.Context, cfg *config.Config) error {
+	publisher, err := mqtt.NewPublisher(cfg)
+	if err != nil {
+		return err
+	}
+	if err := publisher.Connect(ctx); err != nil {
+		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+	defer publisher.Disconnect()
+	return publisher.RemoveDiscovery(ctx)
+}
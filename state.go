@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"dark-detector/internal/calibration"
+	"dark-detector/internal/config"
+	"dark-detector/internal/state"
+)
+
+// stateMaxAge is how old a saved reading may be to seed the filters with.
+// After a longer outage the light has likely changed too much for it to help.
+const stateMaxAge = 15 * time.Minute
+
+// seedLux starts the filters from a reading taken before the detector
+// restarted, so the first new reading doesn't jump.
+func (d *detector) seedLux(lux int) {
+	d.smoother.Update(float64(lux))
+	if d.slewLimit != nil {
+		d.slewLimit.Update(float64(lux))
+	}
+	d.lastLux = &lux
+}
+
+// restoreRetainedState seeds the filters with the lux state the broker
+// retained, for when there is no state file to restore from.
+func (d *detector) restoreRetainedState(ctx context.Context) error {
+	s, err := d.publisher.RetainedState(ctx)
+	if err != nil || s == nil {
+		return err
+	}
+	// Plain states carry no timestamp and are trusted to be recent
+	if !s.Timestamp.IsZero() && time.Since(s.Timestamp) >= stateMaxAge {
+		log.Printf("Ignoring retained reading from %s", s.Timestamp.Format(time.RFC3339))
+		return nil
+	}
+	log.Printf("Restoring retained reading of %d lx", s.Lux)
+	d.seedLux(s.Lux)
+	return nil
+}
+
+// removeStaleDiscovery removes the discovery configs published with a
+// previous configuration that the current one no longer uses, e.g. after
+// changing HASS_NAME changed the unique IDs, so Home Assistant doesn't keep
+// the old entities next to the new ones.
+func (d *detector) removeStaleDiscovery(ctx context.Context) error {
+	current := d.publisher.DiscoveryTopics()
+	var stale []string
+	for _, topic := range d.discovered {
+		if !slices.Contains(current, topic) {
+			stale = append(stale, topic)
+		}
+	}
+	if len(stale) > 0 {
+		log.Printf("Removing %d discovery configs of a previous configuration", len(stale))
+		// The old topics are kept to try again after the next restart
+		if err := d.publisher.ClearDiscovery(ctx, stale); err != nil {
+			return err
+		}
+	}
+	if !slices.Equal(current, d.discovered) {
+		d.discovered = current
+		d.saveState()
+	}
+	return nil
+}
+
+// restoreState continues from the state saved before the last shutdown.
+func (d *detector) restoreState(s *state.State) {
+	if s.Lux != nil && time.Since(s.SavedAt) < stateMaxAge {
+		log.Printf("Restoring last reading of %d lx", *s.Lux)
+		d.seedLux(*s.Lux)
+	}
+
+	d.settings = s.Settings
+	d.discovered = s.DiscoveryTopics
+	if s.Settings.LuxScale != nil {
+		d.setLuxScale(*s.Settings.LuxScale)
+	}
+	if s.Settings.DarkThreshold != nil && d.dark != nil {
+		d.dark.SetThreshold(*s.Settings.DarkThreshold)
+	}
+	if s.Settings.Interval != nil {
+		if *s.Settings.Interval >= 1 {
+			d.setInterval(time.Duration(*s.Settings.Interval) * time.Second)
+		} else {
+			log.Printf("Ignoring saved interval of %ds", *s.Settings.Interval)
+			d.settings.Interval = nil
+		}
+	}
+	if s.Settings.ImageCrop != nil {
+		d.processor.SetCrop(*s.Settings.ImageCrop)
+	}
+	if s.Settings.Paused != nil && *s.Settings.Paused {
+		log.Println("Readings are paused, publish to the resume topic to continue")
+		d.paused = true
+	}
+
+	if d.calibrator != nil {
+		var table *calibration.Table
+		if s.Calibration != nil {
+			curve, err := s.Calibration.NewCurve()
+			if err != nil {
+				log.Printf("Ignoring saved calibration: %v", err)
+			} else if t, ok := curve.(*calibration.Table); ok {
+				table = t
+				d.processor.SetCurve(table)
+			}
+		}
+		d.calibrator.Restore(s.ReferenceSamples, table)
+		log.Printf("Restored %d auto-calibration samples", len(s.ReferenceSamples))
+	}
+}
+
+// saveState saves what the detector learned so far, logging failures since
+// a missed save only costs a little progress after a restart.
+func (d *detector) saveState() {
+	s := &state.State{Lux: d.lastLux, Settings: d.settings, DiscoveryTopics: d.discovered}
+	if d.calibrator != nil {
+		s.ReferenceSamples = d.calibrator.Samples()
+		if table := d.calibrator.Table(); table != nil {
+			s.Calibration = &calibration.File{Curve: config.CurveTable, Table: table.Points()}
+		}
+	}
+	if err := s.Save(d.stateFile); err != nil {
+		log.Printf("Failed to save state: %v", err)
+	}
+}